@@ -2,449 +2,550 @@ package main
 
 import (
 	"bufio"
-	"code.google.com/p/go.crypto/ssh"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"github.com/pkg/sftp"
-	"hash/crc32"
+	"github.com/aarzilli/util/beck"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"regexp"
-	"sort"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unsafe"
 )
 
-const DUMMY = false
+const USAGE = "Usage: beck [-p <profile>] [-wait <duration>] (back [-dry-run] [-restart] [-report] [-progress]|daemon [-schedule <schedule>] [-retry <duration>] [-report]|status|check [-hash <algo>] [-j <n>] [<subdir>]|diff <snapshot> [<snapshot>|-source]|list [-json]|log [-p] <path>|prune [-n] [-keep-* ...]|delete [-n] <snapshot>...|restore <path> [-at <snapshot>] [-to <dir>] [-force] [-dry-run]|extract [<path>] -to <dir> [-at <snapshot>] [-force]|export <snapshot> [<subdir>] [-o <file>] [-z]|import <file> [-as <timestamp>]|sz [-v] [<becksz.sh out>]|verify [<snapshot>])"
 
-const SZDEBUG = false
-const BACKUP_PREFIX = "backup."
-
-const RSYNC_PREFIX = "rsync:"
-
-var sourcePath, backupPath, excludePath, includePath string
-var checkSuccess bool
+func isTerminal(fh *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fh.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
 
-func decideIfRemoteBackup(config string) {
-	fh, err := os.Open(config + "remote")
-	if err == nil {
-		defer fh.Close()
-		b, err := ioutil.ReadAll(fh)
-		if err == nil {
-			backupPath = RSYNC_PREFIX + strings.TrimSpace(string(b))
-			log.Printf("Remote backup enabled: %s", backupPath)
-			return
-		}
+// terminalWidth returns the number of columns of the terminal fh, 80 if it
+// can not be determined
+func terminalWidth(fh *os.File) int {
+	var ws struct{ Row, Col, Xpixel, Ypixel uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fh.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.Col == 0 {
+		return 80
 	}
+	return int(ws.Col)
+}
 
-	dest, err := os.Readlink(backupPath)
-	if err != nil {
-		return
+// askYesNo asks a question on the terminal, def is the answer used if the
+// user just presses enter
+func askYesNo(question string, def bool) bool {
+	if def {
+		fmt.Printf("%s [Y/n] ", question)
+	} else {
+		fmt.Printf("%s [y/N] ", question)
 	}
-	log.Printf("Backup link destination: %s", dest)
-	if strings.HasPrefix(dest, RSYNC_PREFIX) {
-		backupPath = dest
-		log.Printf("Remote backup enabled: %s", backupPath)
-		return
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "":
+		return def
+	case "y", "yes":
+		return true
 	}
+	return false
 }
 
-func initPaths() {
-	config := os.Getenv("XDG_CONFIG_HOME")
-	if config == "" {
-		config = os.Getenv("HOME") + "/.config"
+// readPassword reads a line from the terminal without echoing it
+func readPassword(prompt string) (string, error) {
+	fd := os.Stdin.Fd()
+	var old syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); errno != 0 {
+		return "", errno
 	}
-	config = config + "/beck/"
-
-	sourcePath = config + "source"
-	backupPath = config + "backup"
-	excludePath = config + "exclude"
-	includePath = config + "include"
+	noecho := old
+	noecho.Lflag &^= syscall.ECHO
+	noecho.Lflag |= syscall.ICANON
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&noecho))); errno != 0 {
+		return "", errno
+	}
+	defer func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+		fmt.Fprintf(os.Stderr, "\n")
+	}()
 
-	decideIfRemoteBackup(config)
+	fmt.Fprintf(os.Stderr, "%s", prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
 }
 
-func readableFile(path string) {
-	if file, err := os.Open(path); err != nil {
-		log.Fatalf("Can not read %s\n", path)
-	} else {
-		file.Close()
+// parseArgs parses args with fs allowing flags and positional arguments to be
+// intermixed, returns the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	r := []string{}
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return r
+		}
+		r = append(r, args[0])
+		args = args[1:]
 	}
 }
 
-func validDirLink(path string) {
-	entry, err := os.Lstat(path)
-	if err != nil {
-		log.Fatalf("Can not stat %s\n", path)
-	}
+// progressPrinter shows the progress of a backup, as a status line updated in
+// place on a terminal and as a log line every 10 seconds otherwise
+type progressPrinter struct {
+	tty   bool
+	shown bool
+	last  time.Time
+}
 
-	if (entry.Mode() & os.ModeSymlink) == 0 {
-		log.Fatalf("%s is not a symbolic link", path)
+func (pp *progressPrinter) update(p beck.Progress) {
+	status := fmt.Sprintf("%3d%% %s %s/s ETA %v", p.Percent, beck.HumanReadable(p.Bytes), beck.HumanReadable(int64(p.Rate)), p.ETA)
+	if !pp.tty {
+		if time.Since(pp.last) >= 10*time.Second {
+			pp.last = time.Now()
+			log.Printf("Progress: %s, %d files, %s", status, p.Files, p.File)
+		}
+		return
 	}
-
-	entry, err = os.Stat(path)
-	if err != nil {
-		log.Fatalf("Can not stat path linked by %s\n", path)
+	line := []rune(status + " " + p.File)
+	if w := terminalWidth(os.Stderr) - 1; len(line) > w {
+		line = line[:w]
 	}
+	fmt.Fprintf(os.Stderr, "\r%s\x1b[K", string(line))
+	pp.shown = true
+}
 
-	if (entry.Mode() & os.ModeDir) == 0 {
-		log.Fatalf("Path linked by %s is not a directory\n", path)
+// done clears the status line
+func (pp *progressPrinter) done() {
+	if pp.shown {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K")
+		pp.shown = false
 	}
 }
 
-func isRemoteBackup() bool {
-	return strings.HasPrefix(backupPath, RSYNC_PREFIX)
+// Write clears the status line before writing to stderr, so that log
+// messages are not mixed with it
+func (pp *progressPrinter) Write(buf []byte) (int, error) {
+	pp.done()
+	return os.Stderr.Write(buf)
 }
 
-func parseRemoteBackup(bp string) (user, host, path string) {
-	defer func() {
-		if ierr := recover(); ierr == nil {
-			return
+func doBackup(ctx context.Context, repo *beck.Repository, args []string, wait time.Duration) {
+	fs := flag.NewFlagSet("back", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only show what would be transferred")
+	restart := fs.Bool("restart", false, "Discard interrupted backups instead of resuming them")
+	report := fs.Bool("report", false, "Write a JSON report next to the snapshot and append it to the history log")
+	progress := fs.Bool("progress", false, "Show the progress of the transfer")
+	fs.Parse(args)
+
+	opts := beck.BackupOptions{DryRun: *dryRun, Restart: *restart, Wait: wait, Report: *report}
+	if !*dryRun && isTerminal(os.Stdin) {
+		opts.Resume = func(name string) bool {
+			return askYesNo(fmt.Sprintf("Backup %s was interrupted, resume it?", name), true)
 		}
-		log.Fatalf("Unrecognized remote path \"%s\" expected format rsync:<username>@<host>:<path>", bp)
-	}()
-	a := strings.SplitN(bp, ":", 2)
-	if a[0] != "rsync" {
-		panic("blah")
-	}
-	v := strings.SplitN(a[1], "@", 2)
-	user = v[0]
-	vv := strings.SplitN(v[1], ":", 2)
-	host = vv[0]
-	path = vv[1]
-	return
-}
-
-func getPublicKey() ssh.AuthMethod {
-	fh, err := os.Open(os.ExpandEnv("$HOME/.ssh/id_rsa"))
-	if err != nil {
-		log.Fatalf("Could not open id_rsa: %v\n", err)
 	}
-	defer fh.Close()
-	b, err := ioutil.ReadAll(fh)
-	if err != nil {
-		log.Fatalf("Could not read id_rsa: %v\n", err)
+	pp := &progressPrinter{tty: isTerminal(os.Stderr), last: time.Now()}
+	if *progress {
+		opts.Progress = pp.update
+		if pp.tty {
+			log.SetOutput(pp)
+			defer log.SetOutput(os.Stderr)
+		}
+	}
+	res, err := repo.Backup(ctx, opts)
+	pp.done()
+	if res != nil && !res.DryRun {
+		log.Printf("Backup %s%s: %d files created, %d updated, %d deleted", beck.BACKUP_PREFIX, res.Snapshot, res.Created, res.Updated, res.Deleted)
+		status := ""
+		if cfg := repo.Config(); cfg.Engine == beck.ENGINE_RSYNC && cfg.Format == beck.FORMAT_LINKS {
+			status = fmt.Sprintf(", rsync exit status %d", res.ExitStatus)
+		}
+		log.Printf("Transferred %s of %s (speedup %.2f) in %v%s", beck.HumanReadable(res.TransferredSize), beck.HumanReadable(res.TotalSize), res.Speedup, res.Duration.Round(time.Second), status)
 	}
-	signer, err := ssh.ParsePrivateKey(b)
 	if err != nil {
-		log.Fatalf("Could not parse id_rsa: %v\n", err)
+		log.Fatalf("Backup failed: %v", err)
 	}
-	return ssh.PublicKeys(signer)
 }
 
-func checkConfig() {
-	readableFile(excludePath)
-	readableFile(includePath)
-	validDirLink(sourcePath)
-	if !isRemoteBackup() {
-		validDirLink(backupPath)
+func doCheck(ctx context.Context, repo *beck.Repository, args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	hashName := fs.String("hash", beck.DefaultHash, "Hash algorithm: sha256, blake2b, md5 or crc32")
+	workers := fs.Int("j", 0, "Number of files checked in parallel (default: number of CPUs)")
+	pargs := parseArgs(fs, args)
+	opts := beck.CheckOptions{Hash: *hashName, Jobs: *workers}
+	if len(pargs) > 0 {
+		opts.Subdir = pargs[0]
 	}
-}
 
-func readBackupDirLocal() []string {
-	dir, err := os.Open(backupPath)
-	defer dir.Close()
+	res, err := repo.Check(ctx, opts)
 	if err != nil {
-		log.Fatalf("Can not read %s: %v\n", backupPath, err)
+		log.Fatalf("Check failed: %v", err)
 	}
-
-	backupDirs, err := dir.Readdir(0)
-	if err != nil {
-		log.Fatalf("Can not read %s: %v\n", backupPath, err)
+	log.Printf("Checked %d files in %v: %d hashed (%s, %s), %d hard links already read, %d changed in source, %d failed", res.Files, res.Elapsed, res.Hashed, beck.HumanReadable(res.Bytes), res.Hash, res.Linked, res.Changed, res.Failed)
+	log.Printf("%d missing from the backup, %d created after the backup, %d deleted from source, %d changed type, %d with different metadata", res.Missing, res.Created, res.Extra, res.TypeChanged, res.Metadata)
+	if !res.OK() {
+		log.Printf("Some files did not check correctly")
 	}
+}
 
-	r := make([]string, len(backupDirs))
-	for i := range backupDirs {
-		r[i] = backupDirs[i].Name()
+func doPrune(ctx context.Context, repo *beck.Repository, args []string, wait time.Duration) {
+	cfg := repo.Config()
+	opts := beck.PruneOptions{Policy: cfg.Retention, Wait: wait}
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	fs.BoolVar(&opts.DryRun, "n", false, "Only show what would be removed")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Same as -n")
+	opts.Policy.Flags(fs)
+	fs.Parse(args)
+
+	if opts.Policy.Empty() {
+		if cfg.Profile != "" {
+			log.Fatalf("No retention policy, add keep-* options to profile %s or use the -keep-* options", cfg.Profile)
+		}
+		log.Fatalf("No retention policy, write one in %s or use the -keep-* options", beck.ConfigDir()+"prune")
 	}
 
-	return r
-}
-
-func openSshConnection() *ssh.Client {
-	user, host, _ := parseRemoteBackup(backupPath)
-	log.Printf("Connecting to %s %s", user, host)
-	backupSsh, err := ssh.Dial("tcp", host+":22", &ssh.ClientConfig{User: user, Auth: []ssh.AuthMethod{getPublicKey()}})
+	res, err := repo.Prune(ctx, opts)
 	if err != nil {
-		log.Fatalf("Error connecting to the server: %v", err)
+		log.Fatalf("Prune failed: %v", err)
 	}
-	return backupSsh
+	printRemoved(res, opts.DryRun)
 }
 
-func readBackupDirRemote() []string {
-	_, _, path := parseRemoteBackup(backupPath)
-	backupSsh := openSshConnection()
-	defer backupSsh.Close()
-	backupSftp, err := sftp.NewClient(backupSsh)
-	if err != nil {
-		log.Fatalf("Error initiating sftp session: %v", err)
-	}
-	defer backupSftp.Close()
-	backupDirs, err := backupSftp.ReadDir(path)
-	if err != nil {
-		log.Fatalf("Error reading directory: %v\n", err)
+func doDelete(ctx context.Context, repo *beck.Repository, args []string, wait time.Duration) {
+	opts := beck.DeleteOptions{Wait: wait}
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	fs.BoolVar(&opts.DryRun, "n", false, "Only show what would be removed")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Same as -n")
+	opts.Snapshots = parseArgs(fs, args)
+	if len(opts.Snapshots) == 0 {
+		log.Fatalf("Usage: beck delete [-n] <snapshot>...")
 	}
-	r := make([]string, len(backupDirs))
-	for i := range backupDirs {
-		r[i] = backupDirs[i].Name()
-	}
-	return r
-}
 
-func readBackupDir() []string {
-	if isRemoteBackup() {
-		return readBackupDirRemote()
-	} else {
-		return readBackupDirLocal()
+	res, err := repo.Delete(ctx, opts)
+	if err != nil {
+		log.Fatalf("Delete failed: %v", err)
 	}
+	printRemoved(res, opts.DryRun)
 }
 
-func lastBackupDir() (string, string) {
-	backupDirs := readBackupDir()
-
-	now := time.Now().Format("20060102150405")
-	max := ""
-	re := regexp.MustCompile("^backup\\.(\\d+)$")
-	for _, backupDir := range backupDirs {
-		submatches := re.FindStringSubmatch(backupDir)
-		if submatches == nil {
-			continue
-		}
-		cur := submatches[1]
-		if len(cur) != len("20060102150405") {
-			continue
-		}
-		if submatches[1] > max {
-			max = submatches[1]
+func printRemoved(res *beck.PruneResult, dryRun bool) {
+	for _, date := range res.Dates {
+		if reason, ok := res.Kept[date]; ok {
+			fmt.Printf("keep\t%s%s\t(%s)\n", beck.BACKUP_PREFIX, date, reason)
 		}
 	}
-
-	if max == "" {
-		return "", fmt.Sprintf("%s/backup.%s", backupPath, now)
+	tot := int64(0)
+	for _, date := range res.Removed {
+		fmt.Printf("remove\t%s%s\t%s\n", beck.BACKUP_PREFIX, date, beck.HumanReadable(res.Freed[date]))
+		tot += res.Freed[date]
 	}
-
-	return fmt.Sprintf("%s/backup.%s", backupPath, max), fmt.Sprintf("%s/backup.%s", backupPath, now)
+	verb := "Removed"
+	if dryRun {
+		verb = "Removing"
+	}
+	fmt.Printf("%s %d of %d snapshots frees %s\n", verb, len(res.Removed), len(res.Dates), beck.HumanReadable(tot))
 }
 
-func cmdExec(args ...string) {
-	log.Printf("Executing %v", args)
-	if DUMMY {
-		return
+func doRestore(ctx context.Context, repo *beck.Repository, args []string) {
+	var opts beck.RestoreOptions
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.StringVar(&opts.At, "at", "latest", "Snapshot to restore from: a timestamp (or a prefix of one), latest or N-ago")
+	fs.StringVar(&opts.To, "to", "", "Directory where the file will be restored, by default its original location")
+	fs.BoolVar(&opts.Force, "force", false, "Overwrite files that are newer than the backed up copy")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Only show what would be restored")
+	pargs := parseArgs(fs, args)
+	if len(pargs) != 1 {
+		log.Fatalf("Usage: beck restore <path> [-at <timestamp|latest|N-ago>] [-to <dir>] [-force] [-dry-run]")
 	}
+	opts.Path = pargs[0]
 
-	cmd := exec.Command(args[0], args[1:]...)
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatalf("Could not get stdout of rsync command: %v", err)
+	if err := repo.Restore(ctx, opts); err != nil {
+		log.Fatalf("Restore failed: %v", err)
 	}
+}
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		log.Fatalf("Could not get stderr of rsync command: %v", err)
+func doExtract(ctx context.Context, repo *beck.Repository, args []string) {
+	var opts beck.ExtractOptions
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	fs.StringVar(&opts.At, "at", "latest", "Snapshot to extract from: a timestamp (or a prefix of one), latest or N-ago")
+	fs.StringVar(&opts.To, "to", "", "Directory where the files are extracted")
+	fs.BoolVar(&opts.Force, "force", false, "Overwrite existing files")
+	pargs := parseArgs(fs, args)
+	if len(pargs) > 1 || opts.To == "" {
+		log.Fatalf("Usage: beck extract [<path>] -to <dir> [-at <timestamp|latest|N-ago>] [-force]")
 	}
-
-	err = cmd.Start()
-	if err != nil {
-		log.Fatalf("Could not execute rsync command correctly: %v", err)
+	if len(pargs) == 1 {
+		opts.Path = pargs[0]
 	}
 
-	go io.Copy(os.Stdout, stdout)
-	go io.Copy(os.Stderr, stderr)
-	err = cmd.Wait()
+	n, err := repo.Extract(ctx, opts)
 	if err != nil {
-		log.Fatalf("Error executing rsync command: %v", err)
+		log.Fatalf("Extract failed: %v", err)
 	}
+	log.Printf("Extracted %d files", n)
 }
 
-func cmdExecRemote(sshc *ssh.Client, args ...string) {
-	cmd := strings.Join(args, " ")
-	log.Printf("Executing (remotely) %s", cmd)
-	if DUMMY {
-		return
+func doExport(ctx context.Context, repo *beck.Repository, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "Output file, by default standard output")
+	compress := fs.Bool("z", false, "Compress the archive with gzip (default if the output file ends in .gz or .tgz)")
+	pargs := parseArgs(fs, args)
+	if len(pargs) < 1 || len(pargs) > 2 {
+		log.Fatalf("Usage: beck export <snapshot> [<subdir>] [-o <file>] [-z]")
 	}
-	sshs, err := sshc.NewSession()
-	if err != nil {
-		log.Fatalf("Could not create ssh session: %v", err)
+	opts := beck.ExportOptions{Snapshot: pargs[0], Gzip: *compress}
+	if len(pargs) > 1 {
+		opts.Subdir = pargs[1]
 	}
-	defer sshs.Close()
 
-	stdout, err := sshs.StdoutPipe()
-	if err != nil {
-		log.Fatalf("Could not get stdout of ssh session: %v", err)
-	}
-	stderr, err := sshs.StderrPipe()
-	if err != nil {
-		log.Fatalf("Could not get stderr of ssh session: %v", err)
+	w := os.Stdout
+	if *out != "" {
+		fh, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Could not create %s: %v", *out, err)
+		}
+		w = fh
+		if strings.HasSuffix(*out, ".gz") || strings.HasSuffix(*out, ".tgz") {
+			opts.Gzip = true
+		}
+	} else if isTerminal(os.Stdout) {
+		log.Fatalf("Not writing an archive to a terminal, use -o <file>")
 	}
 
-	err = sshs.Start(cmd)
-	if err != nil {
-		log.Fatalf("Could not execute command: %v", err)
+	err := repo.Export(ctx, w, opts)
+	if err == nil {
+		err = w.Close()
 	}
-
-	go io.Copy(os.Stdout, stdout)
-	go io.Copy(os.Stderr, stderr)
-	err = sshs.Wait()
 	if err != nil {
-		log.Fatalf("Error executing (remote) command: %v", err)
+		if *out != "" {
+			os.Remove(*out)
+		}
+		log.Fatalf("Export failed: %v", err)
 	}
 }
 
-func newBackup(backupPath string) {
-	if isRemoteBackup() {
-		log.Fatalf("Can not create new remote backup yet")
+func doImport(ctx context.Context, repo *beck.Repository, args []string, wait time.Duration) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	as := fs.String("as", "", "Timestamp of the imported snapshot, by default the one of the exported snapshot")
+	pargs := parseArgs(fs, args)
+	if len(pargs) != 1 {
+		log.Fatalf("Usage: beck import <file> [-as <timestamp>]")
+	}
+
+	rd := os.Stdin
+	if pargs[0] != "-" {
+		fh, err := os.Open(pargs[0])
+		if err != nil {
+			log.Fatalf("Could not open %s: %v", pargs[0], err)
+		}
+		defer fh.Close()
+		rd = fh
 	}
-	err := os.Chdir(sourcePath)
+
+	date, err := repo.Import(ctx, rd, beck.ImportOptions{Snapshot: *as, Wait: wait})
 	if err != nil {
-		log.Fatalf("Can not access source directory %s: %v", sourcePath, err)
+		log.Fatalf("Import failed: %v", err)
 	}
+	log.Printf("Imported %s%s", beck.BACKUP_PREFIX, date)
+}
 
-	cmdExec("rsync", "-v", "-a", "--exclude-from="+excludePath, "--include-from="+includePath, ".", backupPath)
+type snapshotInfo struct {
+	Name        string `json:"name"`
+	Date        string `json:"date,omitempty"`
+	AgeSeconds  int64  `json:"age_seconds,omitempty"`
+	Files       int    `json:"files"`
+	Size        int64  `json:"size"`
+	UniqueSize  int64  `json:"unique_size"`
+	Incomplete  bool   `json:"incomplete,omitempty"`
+	Unparseable bool   `json:"unparseable,omitempty"`
 }
 
-func incrementalBackupLocal(oldBackupPath, newBackupPath string) {
-	err := os.Chdir(sourcePath)
-	if err != nil {
-		log.Fatalf("Can not access source directory %s: %v", sourcePath, err)
+func humanAge(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	hours := int((d % (24 * time.Hour)) / time.Hour)
+	if days > 0 {
+		return fmt.Sprintf("%dd%dh", days, hours)
 	}
-
-	cmdExec("rsync", "-v", "-a", "--delete", "--link-dest="+oldBackupPath, "--exclude-from="+excludePath, "--include-from="+includePath, ".", newBackupPath)
+	return fmt.Sprintf("%dh%dm", hours, int((d%time.Hour)/time.Minute))
 }
 
-func incrementalBackupRemote(oldBackupPath, newBackupPath string) {
-	err := os.Chdir(sourcePath)
+func doList(ctx context.Context, repo *beck.Repository, args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	jsonOut := fs.Bool("json", false, "Output JSON")
+	fs.Parse(args)
+
+	snapshots, err := repo.List(ctx)
 	if err != nil {
-		log.Fatalf("Can not access source directory %s: %v", sourcePath, err)
+		log.Fatalf("Could not list backups: %v", err)
 	}
 
-	backupSsh := openSshConnection()
-	defer backupSsh.Close()
-	_, _, obp := parseRemoteBackup(oldBackupPath)
-	user, host, nbp := parseRemoteBackup(newBackupPath)
-	cmdExecRemote(backupSsh, "cp", "--preserve=all", "-l", "--no-dereference", "-R", obp, nbp)
-	cmdExec("rsync", "-e", "ssh", "-v", "-a", "--delete", "--exclude-from="+excludePath, "--include-from="+includePath, ".", user+"@"+host+":"+nbp)
-}
+	if *jsonOut {
+		now := time.Now()
+		infos := make([]snapshotInfo, len(snapshots))
+		for i, s := range snapshots {
+			infos[i] = snapshotInfo{Name: s.Name, Files: s.Files, Size: s.Size, UniqueSize: s.UniqueSize, Incomplete: s.Incomplete, Unparseable: s.Unparseable}
+			if !s.Unparseable {
+				infos[i].Date = s.Time.Format(time.RFC3339)
+				infos[i].AgeSeconds = int64(now.Sub(s.Time) / time.Second)
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		if err := enc.Encode(infos); err != nil {
+			log.Fatalf("Could not write output: %v", err)
+		}
+		return
+	}
 
-func incrementalBackup(oldBackupPath, newBackupPath string) {
-	if isRemoteBackup() {
-		incrementalBackupRemote(oldBackupPath, newBackupPath)
-	} else {
-		incrementalBackupLocal(oldBackupPath, newBackupPath)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "SNAPSHOT\tDATE\tAGE\tFILES\tSIZE\tUNIQUE\tFLAGS\n")
+	for _, s := range snapshots {
+		if s.Unparseable {
+			fmt.Fprintf(w, "%s\t\t\t\t\t\tunparseable\n", s.Name)
+			continue
+		}
+		flags := ""
+		if s.Incomplete {
+			flags = "incomplete"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", s.Name, s.Time.Format("2006-01-02 15:04:05"), humanAge(time.Since(s.Time)), s.Files, beck.HumanReadable(s.Size), beck.HumanReadable(s.UniqueSize), flags)
 	}
+	w.Flush()
 }
 
-func doBackup(lbp, nbp string) {
-	if lbp == "" {
-		newBackup(nbp)
-	} else {
-		incrementalBackup(lbp, nbp)
+func doDiff(ctx context.Context, repo *beck.Repository, args []string) {
+	var opts beck.DiffOptions
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.BoolVar(&opts.Source, "source", false, "Compare the snapshot with the source directory")
+	pargs := parseArgs(fs, args)
+	if len(pargs) < 1 || len(pargs) > 2 || (opts.Source && len(pargs) != 1) {
+		log.Fatalf("Usage: beck diff <snapshot> [<snapshot>|-source]")
+	}
+	opts.From = pargs[0]
+	if len(pargs) == 2 {
+		opts.To = pargs[1]
 	}
-}
 
-func checksum(path string, buf []byte) uint32 {
-	file, err := os.Open(path)
+	changes, err := repo.Diff(ctx, opts)
 	if err != nil {
-		log.Printf("Error reading %s: %v", path, err)
-		return 0
+		log.Fatalf("Diff failed: %v", err)
 	}
-	defer file.Close()
 
-	crc := crc32.NewIEEE()
-	for {
-		n, err := file.Read(buf)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatalf("Error reading %s: %v", path, err)
-		}
-		crc.Write(buf[:n])
+	counts := map[string]int{}
+	for _, c := range changes {
+		fmt.Printf("%s %s\n", c.Kind, c.Path)
+		counts[c.Kind]++
 	}
-
-	//log.Printf("%s -> %v", path, crc.Sum32())
-
-	return crc.Sum32()
+	fmt.Printf("%d added, %d removed, %d modified, %d metadata only\n", counts["+"], counts["-"], counts["M"], counts["m"])
 }
 
-func checkFile(sourcePath, backupPath string, buf []byte) {
-	//log.Printf("Comparing <%s> <%s>", sourcePath, backupPath)
-	if checksum(sourcePath, buf) != checksum(backupPath, buf) {
-		log.Printf("FAILED for %s", sourcePath)
-		checkSuccess = false
+func doLog(ctx context.Context, repo *beck.Repository, args []string) {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	patch := fs.Bool("p", false, "Show the differences between consecutive versions of text files")
+	pargs := parseArgs(fs, args)
+	if len(pargs) != 1 {
+		log.Fatalf("Usage: beck log [-p] <path>")
 	}
-}
 
-func checkDir(sourcePath, backupDir string, shouldPrint bool, buf []byte) {
-	backupFile, err := os.Open(backupDir)
+	versions, err := repo.Log(ctx, pargs[0])
 	if err != nil {
-		log.Fatalf("Can not open backup directory %s: %v", backupDir, err)
+		log.Fatalf("Log failed: %v", err)
 	}
-	defer backupFile.Close()
 
-	var files []os.FileInfo
-	{
-		defer backupFile.Close()
-		files, err = backupFile.Readdir(0)
-		if err != nil {
-			log.Fatalf("Can not read directory %s: %v", backupDir, err)
+	var prev *beck.FileVersion
+	for i := range versions {
+		v := &versions[i]
+		span := beck.BACKUP_PREFIX + v.First
+		if v.Last != v.First {
+			span += " .. " + beck.BACKUP_PREFIX + v.Last
 		}
-	}
-
-	for _, fileInfo := range files {
-		if (fileInfo.Mode() & os.ModeDir) != 0 {
-			if shouldPrint {
-				log.Printf("Checking directory %s", backupDir+"/"+fileInfo.Name())
-			}
-			checkDir(sourcePath+"/"+fileInfo.Name(), backupDir+"/"+fileInfo.Name(), false, buf)
-		} else if (fileInfo.Mode() & os.ModeType) == 0 {
-			// regular file
-			checkFile(sourcePath+"/"+fileInfo.Name(), backupDir+"/"+fileInfo.Name(), buf)
-		} else {
-			log.Printf("Skipping %s", backupDir+"/"+fileInfo.Name())
+		switch {
+		case v.Missing:
+			fmt.Printf("%s\tmissing\n", span)
+			continue
+		case v.Target != "":
+			fmt.Printf("%s\t%s\t-> %s\n", span, v.ModTime.Format("2006-01-02 15:04:05"), v.Target)
+		default:
+			fmt.Printf("%s\t%s\t%s\n", span, v.ModTime.Format("2006-01-02 15:04:05"), beck.HumanReadable(v.Size))
 		}
+		if *patch && prev != nil && prev.Mode.IsRegular() && v.Mode.IsRegular() {
+			printPatch(ctx, repo, pargs[0], prev, v)
+		}
+		prev = v
 	}
 }
 
-func doCheck(backupDir string, subdir string) {
-	if isRemoteBackup() {
-		log.Printf("Can not check remote directory")
-		return
+// printPatch shows the differences between two versions of path as a
+// unified diff
+func printPatch(ctx context.Context, repo *beck.Repository, path string, a, b *beck.FileVersion) {
+	var files [2]string
+	for i, date := range []string{a.Last, b.First} {
+		buf, err := repo.ReadVersion(ctx, date, path)
+		if err != nil {
+			log.Fatalf("Could not read %s: %v", path, err)
+		}
+		if bytes.IndexByte(buf, 0) >= 0 {
+			fmt.Printf("\tbinary file changed\n\n")
+			return
+		}
+		fh, err := ioutil.TempFile("", "beck-log")
+		if err != nil {
+			log.Fatalf("Could not create temporary file: %v", err)
+		}
+		defer os.Remove(fh.Name())
+		_, err = fh.Write(buf)
+		if cerr := fh.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatalf("Could not write temporary file: %v", err)
+		}
+		files[i] = fh.Name()
 	}
-	checkSuccess = true
-	buf := make([]byte, 4086)
-	if subdir != "" {
-		checkDir(sourcePath+"/"+subdir, backupDir+"/"+subdir, true, buf)
-	} else {
-		checkDir(sourcePath, backupDir, true, buf)
+	cmd := exec.CommandContext(ctx, "diff", "-u", "--label", beck.BACKUP_PREFIX+a.Last+"/"+path, "--label", beck.BACKUP_PREFIX+b.First+"/"+path, files[0], files[1])
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	// diff exits with status 1 when the files are different
+	if eerr, ok := err.(*exec.ExitError); err != nil && (!ok || eerr.ExitCode() != 1) {
+		log.Fatalf("diff failed: %v", err)
 	}
-	if !checkSuccess {
-		log.Printf("Some files did not check correctly")
+	if len(out) > 0 {
+		fmt.Printf("%s\n", out)
 	}
 }
 
-func humanReadable(v int) string {
-	if d := float64(v) / float64(1024*1024*1024); d >= 1.0 {
-		return fmt.Sprintf("%0.02fGB", d)
+func doVerify(ctx context.Context, repo *beck.Repository, args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	pargs := parseArgs(fs, args)
+	if len(pargs) > 1 {
+		log.Fatalf("Usage: beck verify [<snapshot>]")
 	}
-
-	if d := float64(v) / float64(1024*1024); d >= 1.0 {
-		return fmt.Sprintf("%0.02fMB", d)
+	spec := "latest"
+	if len(pargs) == 1 {
+		spec = pargs[0]
 	}
 
-	if d := float64(v) / 1024.0; d >= 1.0 {
-		return fmt.Sprintf("%0.02fkB", d)
+	res, err := repo.Verify(ctx, spec)
+	if err != nil {
+		log.Fatalf("Verify failed: %v", err)
 	}
-
-	return fmt.Sprintf("%dB", v)
+	if !res.OK() {
+		log.Fatalf("%s%s does not match its manifest", beck.BACKUP_PREFIX, res.Snapshot)
+	}
+	log.Printf("Verified %d files", res.Files)
 }
 
+// doSz reads the output of becksz.sh, saved in bsop
 func doSz(bsop string, verbose bool) {
-	//TODO: verbose version of sz, show diff files
 	var rd io.Reader
 
 	fh, err := os.Open(bsop)
@@ -464,141 +565,197 @@ func doSz(bsop string, verbose bool) {
 		rd = fh
 	}
 
-	curInode := ""
-	dateList := []string{}
-	totSize := map[string]int{}
-	changes := map[string][]string{}
-	curSz := 0
-	curPath := ""
+	rep, err := beck.ReadSizeReport(rd)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v\n", bsop, err)
+	}
+	rep.Print(os.Stdout, verbose)
+}
+
+func doDaemon(ctx context.Context, cfg beck.Config, args []string, wait time.Duration) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	spec := fs.String("schedule", cfg.Schedule, "When to make backups, an interval (ex. 6h, 1d) or times of day (ex. 03:00, mon,thu 12:30)")
+	retry := fs.Duration("retry", 10*time.Minute, "How long to wait before trying again when a backup fails or the backup directory is not reachable")
+	report := fs.Bool("report", false, "Write a JSON report of every backup")
+	fs.Parse(args)
 
-	flushfn := func() {
-		if len(dateList) <= 0 {
-			return
-		}
+	if *spec == "" {
+		log.Fatalf("No schedule, use -schedule or write one in %s", beck.ConfigDir())
+	}
+	schedule, err := beck.ParseSchedule(*spec)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	opts := beck.DaemonOptions{Schedule: schedule, Retry: *retry, Backup: beck.BackupOptions{Wait: wait, Report: *report}}
+	if err := beck.RunDaemon(ctx, cfg, opts); err != nil {
+		log.Fatalf("Daemon failed: %v", err)
+	}
+}
 
-		sort.Strings(dateList)
-		if _, ok := totSize[dateList[0]]; !ok {
-			totSize[dateList[0]] = 0
-			changes[dateList[0]] = []string{}
+func doStatus(cfg beck.Config) {
+	const timeFormat = "2006-01-02 15:04:05"
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	st, err := beck.ReadDaemonStatus(beck.StatusPath(cfg.Profile))
+	switch {
+	case os.IsNotExist(err):
+		fmt.Fprintf(w, "Daemon:\tnever started\n")
+	case err != nil:
+		log.Fatalf("Could not read status: %v", err)
+	case !st.Running():
+		fmt.Fprintf(w, "Daemon:\tnot running (last update %s)\n", st.Updated.Format(timeFormat))
+	default:
+		fmt.Fprintf(w, "Daemon:\trunning (pid %d) since %s, schedule %q\n", st.PID, st.Started.Format(timeFormat), st.Schedule)
+		fmt.Fprintf(w, "State:\t%s\n", st.State)
+		if !st.LastRun.IsZero() {
+			fmt.Fprintf(w, "Last run:\t%s\n", st.LastRun.Format(timeFormat))
 		}
-		totSize[dateList[0]] += curSz
-		changes[dateList[0]] = append(changes[dateList[0]], fmt.Sprintf("%s %s", humanReadable(curSz), curPath))
-		if SZDEBUG {
-			fmt.Printf("Assigning %s to %s: %s\n", curInode, dateList[0], curPath)
+		if st.State != "running" {
+			fmt.Fprintf(w, "Next run:\t%s\n", st.NextRun.Format(timeFormat))
 		}
-		dateList = dateList[0:0]
+	}
+	if st != nil && st.LastError != "" {
+		fmt.Fprintf(w, "Last error:\t%s\n", st.LastError)
 	}
 
-	scanner := bufio.NewScanner(rd)
-	for scanner.Scan() {
-		line := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 3)
-		switch len(line) {
-		case 0:
-			continue
-		case 3:
-			//nothing
-		default:
-			log.Fatalf("Could not parse input line: <%s>\n", scanner.Text(), len(line))
-		}
+	repo, err := beck.Open(cfg)
+	if err != nil {
+		fmt.Fprintf(w, "Backup directory:\tnot reachable: %v\n", err)
+		return
+	}
+	defer repo.Close()
+	dates, err := repo.Dates()
+	switch {
+	case err != nil:
+		fmt.Fprintf(w, "Backup directory:\tnot reachable: %v\n", err)
+	case len(dates) == 0:
+		fmt.Fprintf(w, "Newest backup:\tnone\n")
+	default:
+		date := dates[len(dates)-1]
+		t, _ := time.ParseInLocation(beck.BACKUP_DATE_FORMAT, date, time.Local)
+		fmt.Fprintf(w, "Newest backup:\t%s%s (%s ago)\n", beck.BACKUP_PREFIX, date, humanAge(time.Since(t)))
+	}
+}
 
-		inode := line[0]
-		sz, err := strconv.ParseInt(line[1], 10, 32)
-		if err != nil {
-			log.Fatalf("Could not parse input line (malformed size): <%s>: %v\n", scanner.Text(), err)
-		}
-		path := strings.Split(line[2], "/")
-		date := ""
-		pathRest := ""
+func main() {
+	profileName := flag.String("p", "", "Profile to use (from the config file)")
+	lockWait := flag.Duration("wait", 0, "How long to wait for other instances of beck using the same backup directory")
+	flag.Parse()
+	os.Args = append(os.Args[:1], flag.Args()...)
 
-		for i := range path {
-			if !strings.HasPrefix(path[i], BACKUP_PREFIX) {
-				continue
-			}
+	if len(os.Args) < 2 {
+		log.Fatalf(USAGE)
+	}
 
-			date = path[i][len(BACKUP_PREFIX):]
-			pathRest = strings.Join(path[i+1:], "/")
-			break
+	szPath := ""
+	szVerbose := false
+	if os.Args[1] == "sz" {
+		for _, arg := range os.Args[2:] {
+			switch arg {
+			case "-v":
+				szVerbose = true
+			default:
+				szPath = arg
+			}
 		}
-
-		if date == "" {
-			log.Fatalf("Could not parse input line (no backup date): <%s>\n", scanner.Text())
+		if szPath != "" {
+			doSz(szPath, szVerbose)
+			return
 		}
+	}
 
-		if curInode != inode {
-			flushfn()
-			curInode = inode
-			curPath = pathRest
-			curSz = int(sz)
-		}
-		dateList = append(dateList, date)
+	cfg, err := beck.LoadConfig(*profileName)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading %s: %v\n", bsop, err)
+	if cfg.Profile != "" {
+		log.Printf("Using profile %s", cfg.Profile)
 	}
-	flushfn()
-
-	ks := make([]string, 0, len(totSize))
-	for k, _ := range totSize {
-		ks = append(ks, k)
+	if strings.HasPrefix(cfg.Destination, beck.RSYNC_PREFIX) {
+		log.Printf("Remote backup enabled: %s", cfg.Destination)
 	}
-	sort.Strings(ks)
-
-	first := true
-	for _, k := range ks {
-		fmt.Printf("%s\t%s\n", k, humanReadable(totSize[k]))
-		if verbose && !first {
-			for i := range changes[k] {
-				fmt.Printf("\t%s\n", changes[k][i])
+	if isTerminal(os.Stdin) {
+		cfg.HostKeyPrompt = func(host, keyType, fingerprint string) bool {
+			return askYesNo(fmt.Sprintf("The authenticity of host %s can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting?", host, keyType, fingerprint), false)
+		}
+		cfg.Passphrase = func(keyPath string) (string, error) {
+			return readPassword(fmt.Sprintf("Enter passphrase for %s: ", keyPath))
+		}
+		cfg.EncryptionPassphrase = func(create bool) (string, error) {
+			pass, err := readPassword(fmt.Sprintf("Enter passphrase for the backup directory %s: ", cfg.Destination))
+			if err != nil || !create {
+				return pass, err
+			}
+			again, err := readPassword("Enter the same passphrase again: ")
+			if err != nil {
+				return "", err
 			}
-			fmt.Printf("\n")
+			if again != pass {
+				return "", fmt.Errorf("passphrases do not match")
+			}
+			return pass, nil
 		}
-		first = false
-	}
-}
-
-func main() {
-	if len(os.Args) < 2 {
-		log.Fatalf("Usage: beck (back|check [<subdir>]|sz <becksz.sh out>)")
 	}
 
-	var lbp, nbp string
-	if os.Args[1] != "sz" {
-		initPaths()
-		checkConfig()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		log.Printf("Interrupted")
+		cancel()
+	}()
 
-		lbp, nbp = lastBackupDir()
+	// these open the backup directory themselves, it does not need to be
+	// reachable
+	switch os.Args[1] {
+	case "daemon":
+		doDaemon(ctx, cfg, os.Args[2:], *lockWait)
+		return
+	case "status":
+		doStatus(cfg)
+		return
+	}
 
-		log.Printf("Last backup directory is: %s, %s\n", lbp, nbp)
+	repo, err := beck.Open(cfg)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
 	}
+	defer repo.Close()
 
 	switch os.Args[1] {
 	case "check":
-		if len(os.Args) == 3 {
-			doCheck(lbp, os.Args[2])
-		} else {
-			doCheck(lbp, "")
-		}
-		break
+		doCheck(ctx, repo, os.Args[2:])
 	case "back":
-		doBackup(lbp, nbp)
-		break
+		doBackup(ctx, repo, os.Args[2:], *lockWait)
+	case "diff":
+		doDiff(ctx, repo, os.Args[2:])
+	case "list":
+		doList(ctx, repo, os.Args[2:])
+	case "verify":
+		doVerify(ctx, repo, os.Args[2:])
+	case "log":
+		doLog(ctx, repo, os.Args[2:])
+	case "prune":
+		doPrune(ctx, repo, os.Args[2:], *lockWait)
+	case "delete":
+		doDelete(ctx, repo, os.Args[2:], *lockWait)
+	case "restore":
+		doRestore(ctx, repo, os.Args[2:])
+	case "extract":
+		doExtract(ctx, repo, os.Args[2:])
+	case "export":
+		doExport(ctx, repo, os.Args[2:])
+	case "import":
+		doImport(ctx, repo, os.Args[2:], *lockWait)
 	case "sz":
-		if len(os.Args) < 3 {
-			log.Fatalf("Usage: beck sz <output of becksz.sh>")
-		}
-
-		path := ""
-		verbose := false
-
-		for i := range os.Args[2:] {
-			switch os.Args[i+2] {
-			case "-v":
-				verbose = true
-			default:
-				path = os.Args[i+2]
-			}
+		rep, err := repo.Sizes(ctx)
+		if err != nil {
+			log.Fatalf("Could not compute sizes: %v", err)
 		}
-
-		doSz(path, verbose)
+		rep.Print(os.Stdout, szVerbose)
+	default:
+		log.Fatalf(USAGE)
 	}
 }
@@ -0,0 +1,358 @@
+package beck
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupOptions are the options of Repository.Backup
+type BackupOptions struct {
+	// DryRun only shows what would be transferred
+	DryRun bool
+	// Restart discards interrupted backups instead of resuming them
+	Restart bool
+	// Wait is how long to wait for other instances of beck using the same
+	// backup directory
+	Wait time.Duration
+	// Resume is called to decide whether the interrupted backup name should
+	// be resumed, if it is nil interrupted backups are always resumed
+	Resume func(name string) bool
+	// Progress, if set, runs rsync with --info=progress2 and is called every
+	// time rsync updates its progress, instead of printing the list of
+	// transferred files
+	Progress func(p Progress)
+	// Report writes the BackupResult as JSON next to the snapshot and
+	// appends it to the history log of the backup directory
+	Report bool
+}
+
+// BackupResult describes a backup, it is also the report written by
+// BackupOptions.Report
+type BackupResult struct {
+	// Snapshot is the timestamp of the new backup
+	Snapshot string `json:"snapshot"`
+	// Base is the timestamp of the backup the new one is incremental to,
+	// empty if it is a full backup
+	Base string `json:"base,omitempty"`
+	// Resumed is the name of the interrupted backup that was resumed
+	Resumed string `json:"resumed,omitempty"`
+	DryRun  bool   `json:"dry_run,omitempty"`
+
+	Start           time.Time     `json:"start"`
+	Duration        time.Duration `json:"-"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	// ExitStatus is the exit status of rsync, -1 if it could not be run or
+	// was killed (or if the native engine failed)
+	ExitStatus int `json:"exit_status"`
+	// Error is the error that stopped the backup
+	Error string `json:"error,omitempty"`
+	// Errors are the files that could not be copied, only reported by the
+	// native engine and by backups in the chunks format
+	Errors []FileError `json:"errors,omitempty"`
+
+	// Transfer is what rsync did, or would have done in a dry run
+	Transfer
+}
+
+// rsyncCommand returns the rsync command line that copies the source
+// directory to dest
+func (r *Repository) rsyncCommand(dest string, args ...string) []string {
+	cmd := append([]string{"rsync"}, args...)
+	cmd = append(cmd, r.rsyncRemoteShell()...)
+	if r.cfg.ExcludeFrom != "" {
+		cmd = append(cmd, "--exclude-from="+r.cfg.ExcludeFrom)
+	}
+	if r.cfg.IncludeFrom != "" {
+		cmd = append(cmd, "--include-from="+r.cfg.IncludeFrom)
+	}
+	for _, pattern := range r.cfg.Exclude {
+		cmd = append(cmd, "--exclude="+pattern)
+	}
+	for _, pattern := range r.cfg.Include {
+		cmd = append(cmd, "--include="+pattern)
+	}
+	cmd = append(cmd, r.cfg.RsyncOptions...)
+	cmd = append(cmd, r.cfg.Roots...)
+	return append(cmd, r.rsyncPath(dest))
+}
+
+// rsync executes a rsync command and summarizes what it did, in a dry run it
+// only summarizes what rsync would do. If progress is set it is called with
+// the progress reported by rsync.
+func (r *Repository) rsync(ctx context.Context, dryRun bool, progress func(Progress), args []string) (Transfer, error) {
+	opts := []string{"rsync", "--stats", "--itemize-changes", "--out-format=%i %l %n%L"}
+	if dryRun {
+		opts = append(opts, "--dry-run")
+		progress = nil
+	}
+	if progress != nil {
+		opts = append(opts, "--info=progress2")
+	}
+	args = append(opts, args[1:]...)
+	if dryRun {
+		r.logf("Executing (dry run) %v", args)
+	} else {
+		r.logf("Executing %v", args)
+	}
+
+	var t Transfer
+	var p Progress
+	err := r.runCmd(ctx, args, func(line string) {
+		if progress == nil {
+			fmt.Fprintln(r.cfg.Stdout, line)
+		} else if parseProgress(line, &p) {
+			progress(p)
+			return
+		} else if rsyncItemRe.MatchString(line) {
+			p.File = strings.SplitN(line, " ", 3)[2]
+		}
+		t.parseLine(line)
+	})
+	if err != nil {
+		return t, err
+	}
+
+	if dryRun {
+		r.logDryRun(t)
+	}
+	return t, nil
+}
+
+// newBackup copies the source directory to name
+func (r *Repository) newBackup(ctx context.Context, dryRun bool, progress func(Progress), name string) (Transfer, error) {
+	if r.remote {
+		if err := r.cmdExecRemote(ctx, dryRun, "mkdir", "-p", shellQuote(r.dir(name))); err != nil {
+			return Transfer{}, err
+		}
+	}
+	return r.rsync(ctx, dryRun, progress, r.rsyncCommand(r.dir(name), "-v", "-a", "--delete"))
+}
+
+// incrementalBackup copies the source directory to name, files that did not
+// change since backup.<base> are hard linked
+func (r *Repository) incrementalBackup(ctx context.Context, dryRun bool, progress func(Progress), base, name string, resuming bool) (Transfer, error) {
+	obp, nbp := r.dir(BACKUP_PREFIX+base), r.dir(name)
+	if !r.remote {
+		return r.rsync(ctx, dryRun, progress, r.rsyncCommand(nbp, "-v", "-a", "--delete", "--link-dest="+obp))
+	}
+
+	var err error
+	if resuming {
+		// only link the files that were not copied yet
+		err = r.cmdExecRemote(ctx, dryRun, "cp", "--preserve=all", "-l", "--no-dereference", "-R", "-n", shellQuote(obp+"/."), shellQuote(nbp+"/"))
+	} else {
+		err = r.cmdExecRemote(ctx, dryRun, "cp", "--preserve=all", "-l", "--no-dereference", "-R", shellQuote(obp), shellQuote(nbp))
+	}
+	if err != nil {
+		return Transfer{}, err
+	}
+	dest := nbp
+	if dryRun && !resuming {
+		// nbp was not created, but it would have been a copy of obp
+		dest = obp
+	}
+	return r.rsync(ctx, dryRun, progress, r.rsyncCommand(dest, "-v", "-a", "--delete"))
+}
+
+var partialRe = regexp.MustCompile("^backup\\.(\\d{14})\\.partial$")
+
+// importRe matches the work directories of Import
+var importRe = regexp.MustCompile("^backup\\.(\\d{14})\\.import$")
+
+// partialBackups returns the names of the backups that were interrupted,
+// sorted from oldest to newest
+func (r *Repository) partialBackups() ([]string, error) {
+	names, err := r.readBackupDir()
+	if err != nil {
+		return nil, err
+	}
+	partials := []string{}
+	for _, name := range names {
+		if partialRe.MatchString(name) {
+			partials = append(partials, name)
+		}
+	}
+	sort.Strings(partials)
+	return partials, nil
+}
+
+func (r *Repository) removeBackupDir(ctx context.Context, dryRun bool, name string) error {
+	if r.remote {
+		return r.cmdExecRemote(ctx, dryRun, "rm", "-rf", shellQuote(r.dir(name)))
+	}
+	if dryRun {
+		r.logf("Would remove %s", r.dir(name))
+		return nil
+	}
+	r.logf("Removing %s", r.dir(name))
+	if err := os.RemoveAll(r.dir(name)); err != nil {
+		return fmt.Errorf("could not remove %s: %v", r.dir(name), err)
+	}
+	return nil
+}
+
+func (r *Repository) renameBackupDir(ctx context.Context, dryRun bool, oldName, newName string) error {
+	if r.remote {
+		return r.cmdExecRemote(ctx, dryRun, "mv", "-T", shellQuote(r.dir(oldName)), shellQuote(r.dir(newName)))
+	}
+	if dryRun {
+		r.logf("Would rename %s to %s", r.dir(oldName), r.dir(newName))
+		return nil
+	}
+	r.logf("Renaming %s to %s", r.dir(oldName), r.dir(newName))
+	if err := os.Rename(r.dir(oldName), r.dir(newName)); err != nil {
+		return fmt.Errorf("could not rename %s to %s: %v", r.dir(oldName), r.dir(newName), err)
+	}
+	return nil
+}
+
+// Backup makes a new backup, incremental to the last one if it exists. The
+// backup is written to a .partial directory which is renamed when the backup
+// is complete, if a partial backup already exists it is resumed (unless
+// opts.Restart is set). The pre-backup hook runs before the backup, if it
+// fails the backup is aborted, afterwards either the post-backup-success or
+// the post-backup-failure hook is run.
+func (r *Repository) Backup(ctx context.Context, opts BackupOptions) (*BackupResult, error) {
+	release, err := r.lock(ctx, opts.DryRun, opts.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	start := time.Now()
+	res := &BackupResult{Snapshot: start.Format(BACKUP_DATE_FORMAT), DryRun: opts.DryRun, Start: start}
+	dates, err := r.Dates()
+	if err != nil {
+		return r.finishBackup(res, opts, false, err)
+	}
+	if len(dates) > 0 {
+		res.Base = dates[len(dates)-1]
+	}
+	if res.Base == res.Snapshot {
+		return r.finishBackup(res, opts, false, fmt.Errorf("backup %s already exists", r.displayPath(BACKUP_PREFIX+res.Snapshot)))
+	}
+	if res.Base != "" {
+		r.logf("Last backup directory is: %s", r.displayPath(BACKUP_PREFIX+res.Base))
+	}
+	if !r.cfg.Encrypted {
+		if fh, err := r.openBackupFile(CRYPT_NAME); err == nil {
+			fh.Close()
+			return r.finishBackup(res, opts, false, fmt.Errorf("%s is an encrypted backup directory but the configuration does not enable encryption", r.cfg.Destination))
+		}
+	}
+	if !r.chunked() {
+		if _, err := r.readDirNames(OBJECTS_DIR); err == nil {
+			return r.finishBackup(res, opts, false, fmt.Errorf("%s is a backup directory in the %s format but the configuration uses %s", r.cfg.Destination, FORMAT_CHUNKS, r.cfg.Format))
+		}
+	}
+
+	if !opts.DryRun {
+		if err := r.runHook(ctx, HOOK_PRE_BACKUP, r.backupHookEnv(res)...); err != nil {
+			return r.finishBackup(res, opts, false, err)
+		}
+	}
+
+	work := BACKUP_PREFIX + res.Snapshot + PARTIAL_SUFFIX
+	partials, err := r.partialBackups()
+	if err != nil {
+		return r.finishBackup(res, opts, false, err)
+	}
+	if len(partials) > 0 {
+		last := partials[len(partials)-1]
+		if !opts.Restart && (opts.Resume == nil || opts.Resume(last)) {
+			r.logf("Resuming interrupted backup %s", last)
+			work = last
+			res.Resumed = last
+			partials = partials[:len(partials)-1]
+		}
+		for _, partial := range partials {
+			if err := r.removeBackupDir(ctx, opts.DryRun, partial); err != nil {
+				return r.finishBackup(res, opts, false, err)
+			}
+		}
+	}
+
+	switch {
+	case r.chunked():
+		res.Transfer, res.Errors, err = r.backupChunked(ctx, opts.DryRun, opts.Progress, res.Base, work, res.Snapshot)
+	case r.cfg.Engine == ENGINE_NATIVE:
+		res.Transfer, res.Errors, err = r.syncNative(ctx, opts.DryRun, opts.Progress, res.Base, work)
+	case res.Base == "":
+		res.Transfer, err = r.newBackup(ctx, opts.DryRun, opts.Progress, work)
+	default:
+		res.Transfer, err = r.incrementalBackup(ctx, opts.DryRun, opts.Progress, res.Base, work, res.Resumed != "")
+	}
+	res.ExitStatus = exitStatus(err)
+	if err != nil {
+		return r.finishBackup(res, opts, false, err)
+	}
+	if err := r.renameBackupDir(ctx, opts.DryRun, work, BACKUP_PREFIX+res.Snapshot); err != nil {
+		return r.finishBackup(res, opts, false, err)
+	}
+	if !opts.DryRun && !r.chunked() {
+		// the tree of chunked backups already names every file after its
+		// hash
+		r.tryWriteManifest(ctx, res.Snapshot, res.Base)
+	}
+	return r.finishBackup(res, opts, true, nil)
+}
+
+// backupHookEnv returns the environment of the backup hooks
+func (r *Repository) backupHookEnv(res *BackupResult) []string {
+	env := []string{"BECK_SNAPSHOT=" + BACKUP_PREFIX + res.Snapshot, "BECK_PREVIOUS="}
+	if res.Base != "" {
+		env[1] += BACKUP_PREFIX + res.Base
+	}
+	return env
+}
+
+// finishBackup records the duration and outcome of a backup, writes its
+// report if requested and runs the post-backup hooks, complete is set if the
+// snapshot was created
+func (r *Repository) finishBackup(res *BackupResult, opts BackupOptions, complete bool, err error) (*BackupResult, error) {
+	res.Duration = time.Since(res.Start)
+	res.DurationSeconds = res.Duration.Seconds()
+	if err != nil {
+		res.Error = err.Error()
+	}
+	if opts.DryRun {
+		return res, err
+	}
+
+	// errors that happen after the backup failed are only logged
+	fail := func(ferr error) {
+		if err == nil {
+			err = ferr
+		} else {
+			r.logf("%v", ferr)
+		}
+	}
+
+	env := r.backupHookEnv(res)
+	if opts.Report {
+		if rerr := r.writeReport(res, complete); rerr != nil {
+			fail(rerr)
+		} else if complete {
+			env = append(env, "BECK_REPORT="+r.displayPath(BACKUP_PREFIX+res.Snapshot+REPORT_SUFFIX))
+		}
+	}
+
+	hook := HOOK_POST_BACKUP_SUCCESS
+	if err == nil {
+		env = append(env, "BECK_STATUS=success")
+	} else {
+		hook = HOOK_POST_BACKUP_FAILURE
+		env = append(env, "BECK_STATUS=failure", "BECK_ERROR="+err.Error())
+	}
+	// the context is not used so that the hooks also run when the backup was
+	// interrupted
+	if herr := r.runHook(context.Background(), hook, env...); herr != nil {
+		fail(herr)
+	}
+	return res, err
+}
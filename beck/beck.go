@@ -0,0 +1,532 @@
+// Package beck makes incremental backups with rsync. Each backup is a
+// backup.<timestamp> directory inside the backup directory, files that did
+// not change since the previous backup are hard links to their previous copy.
+package beck
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const SZDEBUG = false
+const BACKUP_PREFIX = "backup."
+const BACKUP_DATE_FORMAT = "20060102150405"
+
+const RSYNC_PREFIX = "rsync:"
+
+const MANIFEST_SUFFIX = ".manifest.gz"
+const PARTIAL_SUFFIX = ".partial"
+const REPORT_SUFFIX = ".report.json"
+const IMPORT_SUFFIX = ".import"
+
+const HISTORY_NAME = "beck.history"
+
+const LOCK_NAME = "beck.lock"
+const STALE_LOCK_AGE = 48 * time.Hour
+const LOCK_POLL_INTERVAL = 10 * time.Second
+
+// Config describes a backup job
+type Config struct {
+	// Profile is the name of the profile this configuration was read from,
+	// empty for the legacy configuration
+	Profile string
+
+	// Source is the directory that is backed up
+	Source string
+	// Roots are the paths, relative to Source, that are backed up, by default
+	// all of Source
+	Roots []string
+	// Destination is the backup directory, either a local directory or
+	// rsync:[<user>@]<host>:[<port>:]<path>
+	Destination string
+
+	// Exclude and Include are rsync filter patterns, ExcludeFrom and
+	// IncludeFrom are files containing rsync filter patterns
+	Exclude, Include         []string
+	ExcludeFrom, IncludeFrom string
+	// RsyncOptions are passed to every rsync invocation that makes a backup
+	RsyncOptions []string
+	// Engine is what copies files during a backup, ENGINE_RSYNC (the
+	// default) or ENGINE_NATIVE, which does not need rsync but only supports
+	// local backup directories
+	Engine string
+	// Format is how backups are stored, FORMAT_LINKS (the default) or
+	// FORMAT_CHUNKS, see chunked.go. Backups in the chunks format do not use
+	// rsync.
+	Format string
+	// Encrypted makes the backup directory encrypted (and implies
+	// FORMAT_CHUNKS): chunks and snapshot trees are encrypted, with a key
+	// derived from the passphrase or KeyFile, before being written to the
+	// backup directory
+	Encrypted bool
+	// KeyFile is a file whose content is used instead of a passphrase
+	KeyFile string
+
+	// Retention is the retention policy used by Prune when none is specified
+	Retention PrunePolicy
+
+	// Schedule is when the daemon makes backups, see ParseSchedule
+	Schedule string
+
+	// HookDir is the directory containing the hook executables (see
+	// runHook), if it is empty no hooks are run
+	HookDir string
+
+	// Stdout and Stderr receive the output of the commands executed, by
+	// default os.Stdout and os.Stderr
+	Stdout, Stderr io.Writer
+	// Logger receives progress messages, by default the standard logger
+	Logger *log.Logger
+
+	// HostKeyPrompt is called to decide whether an unknown ssh host key should
+	// be trusted (and added to known_hosts), if it is nil unknown hosts are
+	// rejected
+	HostKeyPrompt func(host, keyType, fingerprint string) bool
+	// Passphrase is called to read the passphrase of an encrypted ssh key, if
+	// it is nil encrypted keys are skipped
+	Passphrase func(keyPath string) (string, error)
+	// EncryptionPassphrase is called to read the passphrase of an encrypted
+	// backup directory without a KeyFile, create is set when the backup
+	// directory is being initialized
+	EncryptionPassphrase func(create bool) (string, error)
+}
+
+// Repository is a backup directory, it must be closed after use
+type Repository struct {
+	cfg Config
+
+	remote bool
+	// path is the backup directory, for remote backups it is the path on
+	// the remote host
+	path             string
+	user, host, port string
+
+	sshc  *ssh.Client
+	sftpc *sftp.Client
+	// agentConn is the connection to ssh-agent
+	agentConn net.Conn
+
+	filters []filterRule
+
+	// ckeys are the keys of a backup directory in the chunks format, once
+	// read, trees are the snapshots of that format already read
+	ckeys *cryptKeys
+	trees map[string]*tree
+}
+
+// Open checks cfg and returns the repository it describes, the connection to
+// remote repositories is opened the first time it is needed
+func Open(cfg Config) (*Repository, error) {
+	if cfg.Source == "" {
+		return nil, fmt.Errorf("no source directory")
+	}
+	if cfg.Destination == "" {
+		return nil, fmt.Errorf("no backup directory")
+	}
+	if len(cfg.Roots) == 0 {
+		cfg.Roots = []string{"."}
+	}
+	if cfg.Stdout == nil {
+		cfg.Stdout = os.Stdout
+	}
+	if cfg.Stderr == nil {
+		cfg.Stderr = os.Stderr
+	}
+	if cfg.Engine == "" {
+		cfg.Engine = ENGINE_RSYNC
+	}
+	if cfg.Engine != ENGINE_RSYNC && cfg.Engine != ENGINE_NATIVE {
+		return nil, fmt.Errorf("unknown engine %q", cfg.Engine)
+	}
+	if cfg.KeyFile != "" {
+		cfg.Encrypted = true
+	}
+	if cfg.Format == "" {
+		cfg.Format = FORMAT_LINKS
+		if cfg.Encrypted {
+			cfg.Format = FORMAT_CHUNKS
+		}
+	}
+	if cfg.Format != FORMAT_LINKS && cfg.Format != FORMAT_CHUNKS {
+		return nil, fmt.Errorf("unknown format %q", cfg.Format)
+	}
+	if cfg.Encrypted && cfg.Format != FORMAT_CHUNKS {
+		return nil, fmt.Errorf("encrypted backup directories must use the %s format", FORMAT_CHUNKS)
+	}
+	cfg.Destination = strings.TrimSuffix(cfg.Destination, "/")
+
+	r := &Repository{cfg: cfg, path: cfg.Destination}
+	if strings.HasPrefix(cfg.Destination, RSYNC_PREFIX) {
+		var err error
+		r.user, r.host, r.port, r.path, err = parseRemote(cfg.Destination)
+		if err != nil {
+			return nil, err
+		}
+		r.remote = true
+		if cfg.Engine == ENGINE_NATIVE && cfg.Format == FORMAT_LINKS {
+			return nil, fmt.Errorf("the %s engine does not support remote backup directories", ENGINE_NATIVE)
+		}
+	} else if err := validDir(r.path); err != nil {
+		return nil, err
+	}
+
+	for _, root := range cfg.Roots {
+		if err := validDir(cfg.Source + "/" + root); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.loadFilterRules(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close closes the connection to the remote host
+func (r *Repository) Close() error {
+	if r.sftpc != nil {
+		r.sftpc.Close()
+	}
+	if r.agentConn != nil {
+		r.agentConn.Close()
+	}
+	if r.sshc != nil {
+		return r.sshc.Close()
+	}
+	return nil
+}
+
+// Config returns the configuration of the repository
+func (r *Repository) Config() Config {
+	return r.cfg
+}
+
+// Remote returns true if the backup directory is on a remote host
+func (r *Repository) Remote() bool {
+	return r.remote
+}
+
+// chunked returns true if the backup directory uses FORMAT_CHUNKS
+func (r *Repository) chunked() bool {
+	return r.cfg.Format == FORMAT_CHUNKS
+}
+
+func (r *Repository) logf(format string, args ...interface{}) {
+	printLog(r.cfg.Logger, format, args...)
+}
+
+// printLog writes to logger, or the standard logger if it is nil
+func printLog(logger *log.Logger, format string, args ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// dir returns the path of name inside the backup directory, on the remote
+// host for remote backups
+func (r *Repository) dir(name string) string {
+	return r.path + "/" + name
+}
+
+// displayPath returns the path of name inside the backup directory as shown
+// to the user
+func (r *Repository) displayPath(name string) string {
+	return r.cfg.Destination + "/" + name
+}
+
+func validDir(path string) error {
+	entry, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("can not stat %s: %v", path, err)
+	}
+
+	if (entry.Mode() & os.ModeDir) == 0 {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+// parseRemote parses a remote backup path,
+// rsync:[<username>@]<host>:[<port>:]<path>, port and username can be empty.
+func parseRemote(bp string) (user, host, port, path string, err error) {
+	malformed := fmt.Errorf("unrecognized remote path %q expected format rsync:[<username>@]<host>:[<port>:]<path>", bp)
+	if !strings.HasPrefix(bp, RSYNC_PREFIX) {
+		return "", "", "", "", malformed
+	}
+	rest := bp[len(RSYNC_PREFIX):]
+	if v := strings.SplitN(rest, "@", 2); len(v) == 2 && !strings.Contains(v[0], ":") {
+		user, rest = v[0], v[1]
+	}
+	vv := strings.SplitN(rest, ":", 2)
+	if len(vv) != 2 {
+		return "", "", "", "", malformed
+	}
+	host, path = vv[0], vv[1]
+	if m := remotePortRe.FindStringSubmatch(path); m != nil {
+		port, path = m[1], m[2]
+	}
+	if host == "" || path == "" {
+		return "", "", "", "", malformed
+	}
+	return user, host, port, path, nil
+}
+
+var remotePortRe = regexp.MustCompile("^(\\d+):(.*)$")
+
+// rsyncPath returns the argument for rsync that refers to path in the backup
+// directory
+func (r *Repository) rsyncPath(path string) string {
+	switch {
+	case !r.remote:
+		return path
+	case r.user == "":
+		return r.host + ":" + path
+	default:
+		return r.user + "@" + r.host + ":" + path
+	}
+}
+
+// rsyncRemoteShell returns the arguments that tell rsync how to reach the
+// remote host
+func (r *Repository) rsyncRemoteShell() []string {
+	if !r.remote {
+		return nil
+	}
+	if r.port != "" {
+		return []string{"-e", "ssh -p " + r.port}
+	}
+	return []string{"-e", "ssh"}
+}
+
+// client returns the ssh connection to the remote host
+func (r *Repository) client() (*ssh.Client, error) {
+	if r.sshc == nil {
+		sshc, err := r.dial()
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to the server: %v", err)
+		}
+		r.sshc = sshc
+	}
+	return r.sshc, nil
+}
+
+// sftpClient returns a sftp session on the remote host
+func (r *Repository) sftpClient() (*sftp.Client, error) {
+	if r.sftpc == nil {
+		sshc, err := r.client()
+		if err != nil {
+			return nil, err
+		}
+		sftpc, err := sftp.NewClient(sshc)
+		if err != nil {
+			return nil, fmt.Errorf("error initiating sftp session: %v", err)
+		}
+		r.sftpc = sftpc
+	}
+	return r.sftpc, nil
+}
+
+func (r *Repository) readBackupDir() ([]string, error) {
+	var backupDirs []os.FileInfo
+	if r.remote {
+		sftpc, err := r.sftpClient()
+		if err != nil {
+			return nil, err
+		}
+		backupDirs, err = sftpc.ReadDir(r.path)
+		if err != nil {
+			return nil, fmt.Errorf("can not read %s: %v", r.cfg.Destination, err)
+		}
+	} else {
+		var err error
+		backupDirs, err = ioutil.ReadDir(r.path)
+		if err != nil {
+			return nil, fmt.Errorf("can not read %s: %v", r.cfg.Destination, err)
+		}
+	}
+
+	names := make([]string, len(backupDirs))
+	for i := range backupDirs {
+		names[i] = backupDirs[i].Name()
+	}
+	return names, nil
+}
+
+// Dates returns the timestamps of all backup.<timestamp> directories in the
+// backup directory, sorted from oldest to newest
+func (r *Repository) Dates() ([]string, error) {
+	backupDirs, err := r.readBackupDir()
+	if err != nil {
+		return nil, err
+	}
+
+	dates := []string{}
+	for _, backupDir := range backupDirs {
+		if date, ok := backupDateOf(backupDir); ok {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+	return dates, nil
+}
+
+var backupDirRe = regexp.MustCompile("^backup\\.(\\d+)$")
+
+// backupDateOf returns the timestamp part of a backup.<timestamp> directory name
+func backupDateOf(name string) (string, bool) {
+	submatches := backupDirRe.FindStringSubmatch(name)
+	if submatches == nil {
+		return "", false
+	}
+	if _, err := time.ParseInLocation(BACKUP_DATE_FORMAT, submatches[1], time.Local); err != nil {
+		return "", false
+	}
+	return submatches[1], true
+}
+
+// parseBackupDate converts a timestamp returned by backupDateOf to a time
+func parseBackupDate(date string) time.Time {
+	t, _ := time.ParseInLocation(BACKUP_DATE_FORMAT, date, time.Local)
+	return t
+}
+
+// runCmd executes args in the source directory, if linefn isn't nil it is
+// called for every line of standard output instead of copying it to
+// Config.Stdout
+func (r *Repository) runCmd(ctx context.Context, args []string, linefn func(line string)) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = r.cfg.Source
+	cmd.Stderr = r.cfg.Stderr
+
+	if linefn == nil {
+		cmd.Stdout = r.cfg.Stdout
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("error executing %s: %w", args[0], err)
+		}
+		return nil
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("could not get stdout of %s: %v", args[0], err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not execute %s: %v", args[0], err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanLines)
+	for scanner.Scan() {
+		linefn(scanner.Text())
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("error executing %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// runSession runs cmd in sshs, the session is closed if ctx is cancelled
+func runSession(ctx context.Context, sshs *ssh.Session, cmd string) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sshs.Signal(ssh.SIGTERM)
+			sshs.Close()
+		case <-done:
+		}
+	}()
+	err := sshs.Run(cmd)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (r *Repository) cmdExecRemote(ctx context.Context, dryRun bool, args ...string) error {
+	cmd := strings.Join(args, " ")
+	if dryRun {
+		r.logf("Would execute (remotely) %s", cmd)
+		return nil
+	}
+	r.logf("Executing (remotely) %s", cmd)
+	sshc, err := r.client()
+	if err != nil {
+		return err
+	}
+	sshs, err := sshc.NewSession()
+	if err != nil {
+		return fmt.Errorf("could not create ssh session: %v", err)
+	}
+	defer sshs.Close()
+	sshs.Stdout = r.cfg.Stdout
+	sshs.Stderr = r.cfg.Stderr
+	if err := runSession(ctx, sshs, cmd); err != nil {
+		return fmt.Errorf("error executing (remote) command: %v", err)
+	}
+	return nil
+}
+
+// cmdOutputRemote executes a command on the remote host and returns its
+// output, stdin can be nil
+func (r *Repository) cmdOutputRemote(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	err := r.cmdStreamRemote(ctx, stdin, &out, args...)
+	return out.Bytes(), err
+}
+
+// cmdStreamRemote executes a command on the remote host connecting its
+// standard input and output to stdin and stdout, stdin can be nil
+func (r *Repository) cmdStreamRemote(ctx context.Context, stdin io.Reader, stdout io.Writer, args ...string) error {
+	cmd := strings.Join(args, " ")
+	r.logf("Executing (remotely) %s", cmd)
+	sshc, err := r.client()
+	if err != nil {
+		return err
+	}
+	sshs, err := sshc.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sshs.Close()
+	sshs.Stdin = stdin
+	sshs.Stdout = stdout
+	sshs.Stderr = r.cfg.Stderr
+	return runSession(ctx, sshs, cmd)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+}
+
+func HumanReadable(v int64) string {
+	if d := float64(v) / float64(1024*1024*1024); d >= 1.0 {
+		return fmt.Sprintf("%0.02fGB", d)
+	}
+
+	if d := float64(v) / float64(1024*1024); d >= 1.0 {
+		return fmt.Sprintf("%0.02fMB", d)
+	}
+
+	if d := float64(v) / 1024.0; d >= 1.0 {
+		return fmt.Sprintf("%0.02fkB", d)
+	}
+
+	return fmt.Sprintf("%dB", v)
+}
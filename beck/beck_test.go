@@ -0,0 +1,33 @@
+package beck
+
+import "testing"
+
+func TestParseRemote(t *testing.T) {
+	tests := []struct {
+		in                     string
+		user, host, port, path string
+		ok                     bool
+	}{
+		{"rsync:host:/backup", "", "host", "", "/backup", true},
+		{"rsync:me@host:/backup", "me", "host", "", "/backup", true},
+		{"rsync:me@host:2222:/backup", "me", "host", "2222", "/backup", true},
+		{"rsync:host:2222:backup", "", "host", "2222", "backup", true},
+		{"rsync:host:relative/dir", "", "host", "", "relative/dir", true},
+		{"rsync:host:/a@b", "", "host", "", "/a@b", true},
+		{"rsync:host", "", "", "", "", false},
+		{"rsync::/backup", "", "", "", "", false},
+		{"rsync:host:", "", "", "", "", false},
+		{"rsync:host:2222:", "", "", "", "", false},
+		{"host:/backup", "", "", "", "", false},
+	}
+	for _, tc := range tests {
+		user, host, port, path, err := parseRemote(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: unexpected error %v", tc.in, err)
+			continue
+		}
+		if user != tc.user || host != tc.host || port != tc.port || path != tc.path {
+			t.Errorf("%q: got %q %q %q %q, expected %q %q %q %q", tc.in, user, host, port, path, tc.user, tc.host, tc.port, tc.path)
+		}
+	}
+}
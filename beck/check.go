@@ -0,0 +1,626 @@
+package beck
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type hashAlgo struct {
+	name string
+	new  func() hash.Hash
+	// remote is the command used to compute the hash on the remote host, if
+	// it is empty files are downloaded and hashed locally
+	remote string
+}
+
+var hashAlgos = []hashAlgo{
+	{"sha256", sha256.New, "sha256sum"},
+	{"blake2b", func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	}, "b2sum"},
+	{"md5", md5.New, "md5sum"},
+	{"crc32", func() hash.Hash { return crc32.NewIEEE() }, ""},
+}
+
+// DefaultHash is the hash algorithm used by manifests and, unless otherwise
+// specified, by Check
+const DefaultHash = "sha256"
+
+func hashByName(name string) (hashAlgo, error) {
+	if name == "" {
+		name = DefaultHash
+	}
+	for _, algo := range hashAlgos {
+		if algo.name == name {
+			return algo, nil
+		}
+	}
+	return hashAlgo{}, fmt.Errorf("unknown hash algorithm %s", name)
+}
+
+func checksum(algo hashAlgo, path string, buf []byte) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return checksumReader(algo, file, buf)
+}
+
+func checksumReader(algo hashAlgo, rd io.Reader, buf []byte) (string, error) {
+	h := algo.new()
+	if _, err := io.CopyBuffer(h, rd, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CheckOptions are the options of Repository.Check
+type CheckOptions struct {
+	// Snapshot is the backup to check (see Resolve), by default the latest
+	Snapshot string
+	// Subdir restricts the check to a directory, relative to the source
+	// directory
+	Subdir string
+	// Hash is the hash algorithm used to compare files: sha256 (the
+	// default), blake2b, md5 or crc32
+	Hash string
+	// Jobs is the number of files checked in parallel, by default the
+	// number of CPUs
+	Jobs int
+}
+
+// Problem is a difference between the source directory and a backup
+type Problem struct {
+	// Kind is one of FAILED, SYMLINK and MISSING (errors of the backup) or
+	// CHANGED, NEW, EXTRA, TYPE and METADATA (changes of the source directory
+	// made after the backup)
+	Kind string
+	Path string
+}
+
+// CheckResult counts what happened during a check
+type CheckResult struct {
+	Snapshot    string
+	Hash        string
+	Elapsed     time.Duration
+	Files       int
+	Hashed      int
+	Linked      int
+	Changed     int
+	Failed      int
+	Missing     int
+	Created     int
+	Extra       int
+	TypeChanged int
+	Metadata    int
+	Bytes       int64
+	Problems    []Problem
+}
+
+// OK returns true if the backup is a correct copy of the source directory
+func (res *CheckResult) OK() bool {
+	return res.Failed == 0 && res.Missing == 0
+}
+
+// checker holds the state of a check, it is shared between the workers
+type checker struct {
+	r    *Repository
+	ctx  context.Context
+	hash hashAlgo
+
+	mu  sync.Mutex
+	res *CheckResult
+	// backupHashes are the hashes of the backup files already read, by
+	// inode
+	backupHashes map[fileId]string
+	// snapshotTime is the time the checked backup was made
+	snapshotTime time.Time
+}
+
+// checkJob is a regular file that has the same size and modification time
+// in the source directory and in the backup, rel is its path relative to
+// both
+type checkJob struct {
+	sourcePath, backupPath, rel string
+	sourceInfo, backupInfo      os.FileInfo
+}
+
+// backupLister reads the backup being checked, paths are relative to the
+// backup
+type backupLister struct {
+	// readDir returns the entries of a directory indexed by name
+	readDir  func(rel string) (map[string]os.FileInfo, error)
+	readlink func(rel string) (string, error)
+}
+
+func (c *checker) failure(path string) {
+	c.fail("FAILED for", path)
+}
+
+func (c *checker) fail(kind, path string) {
+	c.mu.Lock()
+	c.r.logf("%s %s", kind, path)
+	c.res.Failed++
+	c.res.Problems = append(c.res.Problems, Problem{strings.TrimSuffix(kind, " for"), path})
+	c.mu.Unlock()
+}
+
+// difference reports a difference between source and backup that is not an
+// error of the backup
+func (c *checker) difference(kind, path string, counter *int) {
+	c.mu.Lock()
+	c.r.logf("%s %s", kind, path)
+	*counter++
+	c.res.Problems = append(c.res.Problems, Problem{kind, path})
+	c.mu.Unlock()
+}
+
+// missingFromBackup reports path, which exists in the source directory but
+// not in the backup. It's only an error if path already existed when the
+// backup was made.
+func (c *checker) missingFromBackup(path string, info os.FileInfo) {
+	if info.ModTime().After(c.snapshotTime) {
+		c.difference("NEW", path, &c.res.Created)
+		return
+	}
+	c.mu.Lock()
+	c.r.logf("MISSING %s", path)
+	c.res.Missing++
+	c.res.Problems = append(c.res.Problems, Problem{"MISSING", path})
+	c.mu.Unlock()
+}
+
+// sameVersion returns true if the backup is a copy of the current version of
+// the source file, judging by size and modification time
+func sameVersion(source, backup os.FileInfo) bool {
+	return source.Size() == backup.Size() && source.ModTime().Unix() == backup.ModTime().Unix()
+}
+
+func ownerOf(info os.FileInfo) (uid, gid uint32, ok bool) {
+	switch st := info.Sys().(type) {
+	case *syscall.Stat_t:
+		return st.Uid, st.Gid, true
+	case *sftp.FileStat:
+		return st.UID, st.GID, true
+	case *treeEntry:
+		return st.Uid, st.Gid, true
+	}
+	return 0, 0, false
+}
+
+// sameOwnerAndMode compares permissions and ownership of a file and its
+// backup
+func sameOwnerAndMode(source, backup os.FileInfo) bool {
+	const modeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	if (source.Mode() & modeMask) != (backup.Mode() & modeMask) {
+		return false
+	}
+	suid, sgid, sok := ownerOf(source)
+	buid, bgid, bok := ownerOf(backup)
+	return !sok || !bok || (suid == buid && sgid == bgid)
+}
+
+// checkEntry compares everything but the contents of a file that exists both
+// in the source directory and in the backup, returns false if they have
+// different types
+func (c *checker) checkEntry(sourcePath, rel string, sourceInfo, backupInfo os.FileInfo, readlink func(string) (string, error)) bool {
+	if (sourceInfo.Mode() & os.ModeType) != (backupInfo.Mode() & os.ModeType) {
+		c.difference("TYPE", sourcePath, &c.res.TypeChanged)
+		return false
+	}
+
+	if (sourceInfo.Mode() & os.ModeSymlink) != 0 {
+		st, serr := os.Readlink(sourcePath)
+		bt, berr := readlink(rel)
+		if serr != nil || berr != nil || st != bt {
+			c.fail("SYMLINK", sourcePath)
+		}
+		// permissions of symbolic links are meaningless
+		return true
+	}
+
+	if !sameOwnerAndMode(sourceInfo, backupInfo) {
+		c.difference("METADATA", sourcePath, &c.res.Metadata)
+	}
+	return true
+}
+
+// compare hashes a source file and returns true if it matches hash, the
+// hash of its backup
+func (c *checker) compare(sourcePath, hash string, buf []byte) bool {
+	sourceHash, err := checksum(c.hash, sourcePath, buf)
+	if err != nil {
+		c.r.logf("Error reading %s: %v", sourcePath, err)
+		return false
+	}
+	return hash != "" && sourceHash == hash
+}
+
+// checkFile compares a file of a local backup with its source. The backup of
+// a file is read once for all its hard links, but every source file is hashed
+// since different source files can be linked to the same backup file.
+func (c *checker) checkFile(job checkJob, buf []byte) {
+	st := job.backupInfo.Sys().(*syscall.Stat_t)
+	id := fileId{uint64(st.Dev), uint64(st.Ino)}
+	c.mu.Lock()
+	backupHash, linked := c.backupHashes[id]
+	if linked {
+		c.res.Linked++
+	}
+	c.mu.Unlock()
+
+	if !linked {
+		var err error
+		backupHash, err = checksum(c.hash, job.backupPath, buf)
+		if err != nil {
+			c.r.logf("Error reading %s: %v", job.backupPath, err)
+		}
+		c.mu.Lock()
+		c.res.Hashed++
+		c.res.Bytes += job.backupInfo.Size()
+		if err == nil {
+			c.backupHashes[id] = backupHash
+		}
+		c.mu.Unlock()
+	}
+
+	if !c.compare(job.sourcePath, backupHash, buf) {
+		c.failure(job.sourcePath)
+	}
+}
+
+func readDirMap(dir string) (map[string]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[string]os.FileInfo, len(files))
+	for _, fileInfo := range files {
+		r[fileInfo.Name()] = fileInfo
+	}
+	return r, nil
+}
+
+// checkDir compares the directory rel of the source directory with its copy
+// in the backup, listed by backup. Regular files that did not change since
+// the backup are passed to compare.
+func (c *checker) checkDir(rel string, backup backupLister, shouldPrint bool, compare func(job checkJob)) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	r := c.r
+	sourceDir := filepath.Join(r.cfg.Source, rel)
+	sourceFiles, err := readDirMap(sourceDir)
+	if err != nil {
+		return fmt.Errorf("can not read directory %s: %v", sourceDir, err)
+	}
+	backupFiles, err := backup.readDir(rel)
+	if os.IsNotExist(err) {
+		// only happens for the roots, everything is missing
+		backupFiles, err = map[string]os.FileInfo{}, nil
+	}
+	if err != nil {
+		return fmt.Errorf("can not read directory %s: %v", c.backupPath(rel), err)
+	}
+
+	names := make([]string, 0, len(sourceFiles)+len(backupFiles))
+	for name := range sourceFiles {
+		names = append(names, name)
+	}
+	for name := range backupFiles {
+		if _, ok := sourceFiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sourceInfo, inSource := sourceFiles[name]
+		backupInfo, inBackup := backupFiles[name]
+		childRel := filepath.Join(rel, name)
+		sp, bp := sourceDir+"/"+name, c.backupPath(childRel)
+
+		var isDir bool
+		if inSource {
+			isDir = sourceInfo.IsDir()
+		} else {
+			isDir = backupInfo.IsDir()
+		}
+		if r.excluded(childRel, isDir) {
+			continue
+		}
+
+		switch {
+		case !inBackup:
+			c.missingFromBackup(sp, sourceInfo)
+		case !inSource:
+			c.difference("EXTRA", bp, &c.res.Extra)
+		case !c.checkEntry(sp, childRel, sourceInfo, backupInfo, backup.readlink):
+			// different types
+		case isDir:
+			if shouldPrint {
+				r.logf("Checking directory %s", bp)
+			}
+			if err := c.checkDir(childRel, backup, false, compare); err != nil {
+				return err
+			}
+		case (backupInfo.Mode() & os.ModeType) == 0:
+			// regular file
+			c.mu.Lock()
+			c.res.Files++
+			c.mu.Unlock()
+			if !sameVersion(sourceInfo, backupInfo) {
+				c.difference("CHANGED", sp, &c.res.Changed)
+				continue
+			}
+			compare(checkJob{sp, bp, childRel, sourceInfo, backupInfo})
+		}
+	}
+	return nil
+}
+
+// backupPath returns the path of rel in the checked backup
+func (c *checker) backupPath(rel string) string {
+	return c.r.dir(BACKUP_PREFIX + c.res.Snapshot + "/" + filepath.ToSlash(rel))
+}
+
+// checkTree compares the roots of the source directory (or subdir) with
+// their backup, see checkDir
+func (c *checker) checkTree(subdir string, backup backupLister, compare func(job checkJob)) error {
+	for _, root := range c.r.checkRoots(subdir) {
+		if err := c.checkDir(filepath.Clean(root), backup, true, compare); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRoots returns the directories, relative to the source directory, that
+// should be checked
+func (r *Repository) checkRoots(subdir string) []string {
+	if subdir != "" {
+		return []string{filepath.Clean(subdir)}
+	}
+	return r.cfg.Roots
+}
+
+// remoteHashes hashes every regular file under dir on the remote host and
+// returns a map from the path (relative to dir) to its hash
+func (r *Repository) remoteHashes(ctx context.Context, algo hashAlgo, dir string) (map[string]string, error) {
+	if algo.remote == "" {
+		return nil, fmt.Errorf("%s can not be computed remotely", algo.name)
+	}
+	out, err := r.cmdOutputRemote(ctx, nil, "cd", shellQuote(dir), "&&", "find", ".", "-type", "f", "-exec", algo.remote, "{}", "+")
+	if err != nil {
+		return nil, err
+	}
+	return parseHashOutput(out)
+}
+
+// remoteHashesOf is like remoteHashes but only hashes the specified files
+func (r *Repository) remoteHashesOf(ctx context.Context, algo hashAlgo, dir string, paths []string) (map[string]string, error) {
+	if algo.remote == "" {
+		return nil, fmt.Errorf("%s can not be computed remotely", algo.name)
+	}
+	var stdin bytes.Buffer
+	for _, path := range paths {
+		stdin.WriteString(path)
+		stdin.WriteByte(0)
+	}
+	out, err := r.cmdOutputRemote(ctx, &stdin, "cd", shellQuote(dir), "&&", "xargs", "-0", "-r", algo.remote)
+	if err != nil {
+		return nil, err
+	}
+	return parseHashOutput(out)
+}
+
+// parseHashOutput parses the output of md5sum and similar programs
+func parseHashOutput(out []byte) (map[string]string, error) {
+	r := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		escaped := line[0] == '\\'
+		if escaped {
+			line = line[1:]
+		}
+		v := strings.SplitN(line, "  ", 2)
+		if len(v) != 2 {
+			return nil, fmt.Errorf("could not parse hash output: <%s>", line)
+		}
+		path := v[1]
+		if escaped {
+			path = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(path)
+		}
+		r[strings.TrimPrefix(path, "./")] = v[0]
+	}
+	return r, nil
+}
+
+func (c *checker) checkRemote(date, subdir string) error {
+	r := c.r
+	bp := r.dir(BACKUP_PREFIX + date)
+
+	backupSftp, err := r.sftpClient()
+	if err != nil {
+		return err
+	}
+
+	// only the checked roots are hashed, hashes are indexed by the path
+	// relative to the backup
+	hashes := map[string]string{}
+	for _, root := range r.checkRoots(subdir) {
+		root = filepath.ToSlash(filepath.Clean(root))
+		rootHashes, err := r.remoteHashes(c.ctx, c.hash, path.Join(bp, root))
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return c.ctx.Err()
+			}
+			r.logf("Could not hash files remotely, they will be downloaded instead: %v", err)
+			hashes = nil
+			break
+		}
+		for p, h := range rootHashes {
+			if root != "." {
+				p = root + "/" + p
+			}
+			hashes[p] = h
+		}
+	}
+
+	buf := make([]byte, 64*1024)
+	compare := func(job checkJob) {
+		rel := filepath.ToSlash(job.rel)
+		var remoteHash string
+		if hashes != nil {
+			remoteHash = hashes[rel]
+		} else {
+			fh, err := backupSftp.Open(bp + "/" + rel)
+			if err == nil {
+				remoteHash, err = checksumReader(c.hash, fh, buf)
+				fh.Close()
+			}
+			if err != nil {
+				r.logf("Error reading %s: %v", job.backupPath, err)
+			}
+		}
+		c.res.Hashed++
+		c.res.Bytes += job.backupInfo.Size()
+		if !c.compare(job.sourcePath, remoteHash, buf) {
+			c.failure(job.sourcePath)
+		}
+	}
+
+	backup := backupLister{
+		readDir: func(rel string) (map[string]os.FileInfo, error) {
+			infos, err := backupSftp.ReadDir(path.Join(bp, filepath.ToSlash(rel)))
+			if err != nil {
+				return nil, err
+			}
+			files := make(map[string]os.FileInfo, len(infos))
+			for _, info := range infos {
+				files[info.Name()] = info
+			}
+			return files, nil
+		},
+		readlink: func(rel string) (string, error) {
+			return backupSftp.ReadLink(path.Join(bp, filepath.ToSlash(rel)))
+		},
+	}
+	return c.checkTree(subdir, backup, compare)
+}
+
+func (c *checker) checkLocal(date, subdir string, workers int) error {
+	r := c.r
+	jobs := make(chan checkJob, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 64*1024)
+			for job := range jobs {
+				if c.ctx.Err() == nil {
+					c.checkFile(job, buf)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.mu.Lock()
+				r.logf("Checked %d files (%s hashed)", c.res.Files, HumanReadable(c.res.Bytes))
+				c.mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	backupDir := r.dir(BACKUP_PREFIX + date)
+	backup := backupLister{
+		readDir: func(rel string) (map[string]os.FileInfo, error) {
+			return readDirMap(filepath.Join(backupDir, rel))
+		},
+		readlink: func(rel string) (string, error) {
+			return os.Readlink(filepath.Join(backupDir, rel))
+		},
+	}
+	err := c.checkTree(subdir, backup, func(job checkJob) {
+		jobs <- job
+	})
+	close(jobs)
+	wg.Wait()
+	close(done)
+	if err == nil {
+		err = c.ctx.Err()
+	}
+	return err
+}
+
+// Check compares a backup with the source directory, every difference is
+// logged and returned in CheckResult.Problems
+func (r *Repository) Check(ctx context.Context, opts CheckOptions) (*CheckResult, error) {
+	algo, err := hashByName(opts.Hash)
+	if err != nil {
+		return nil, err
+	}
+	workers := opts.Jobs
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	date, err := r.Resolve(opts.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	r.logf("Checking %s", r.displayPath(BACKUP_PREFIX+date))
+
+	start := time.Now()
+	c := &checker{
+		r:            r,
+		ctx:          ctx,
+		hash:         algo,
+		res:          &CheckResult{Snapshot: date, Hash: algo.name},
+		backupHashes: map[fileId]string{},
+		snapshotTime: parseBackupDate(date),
+	}
+
+	switch {
+	case r.chunked():
+		err = c.checkChunked(date, opts.Subdir)
+	case r.remote:
+		err = c.checkRemote(date, opts.Subdir)
+	default:
+		err = c.checkLocal(date, opts.Subdir, workers)
+	}
+	c.res.Elapsed = time.Since(start)
+	return c.res, err
+}
@@ -0,0 +1,481 @@
+package beck
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// Formats of the backup directory, see Config.Format.
+//
+// In the links format every backup is a backup.<timestamp> directory, files
+// that did not change since the previous backup are hard links to their
+// previous copy.
+//
+// In the chunks format files are split into content defined chunks (see
+// chunker) which are stored once, in objects/, named after their hash. Every
+// backup is a backup.<timestamp> file listing the files of the snapshot with
+// the chunks they are made of (see tree), so that a chunk is stored once no
+// matter how many files, in how many backups, contain it. Chunks that are no
+// longer used by any backup are removed by Prune and Delete.
+const (
+	FORMAT_LINKS  = "links"
+	FORMAT_CHUNKS = "chunks"
+)
+
+// notChunked returns an error if the backup directory uses the chunks
+// format, op is the operation that was attempted
+func (r *Repository) notChunked(op string) error {
+	if r.chunked() {
+		return fmt.Errorf("%s is not supported on backup directories in the %s format", op, FORMAT_CHUNKS)
+	}
+	return nil
+}
+
+// chunkedBackup writes a snapshot of the source directory to a backup
+// directory in the chunks format
+type chunkedBackup struct {
+	copier
+	ctx    context.Context
+	k      *cryptKeys
+	dryRun bool
+
+	// source is the source directory with symbolic links resolved, root is
+	// the root being copied
+	source, root string
+	// prev are the entries of the previous snapshot, indexed by path
+	prev map[string]*treeEntry
+	// objects are the objects already in the backup directory
+	objects map[string]bool
+	entries []treeEntry
+	seen    map[string]bool
+	buf     []byte
+}
+
+// backupChunked writes the tree of a snapshot of the source directory to the
+// file name, as backup.<date>. Only the chunks that are not already in the
+// backup directory are written, the files that have the same size and
+// modification time they had in backup.<base> (if base is not empty) are not
+// even read.
+func (r *Repository) backupChunked(ctx context.Context, dryRun bool, progress func(Progress), base, name, date string) (Transfer, []FileError, error) {
+	b := &chunkedBackup{copier: newCopier(r, dryRun, progress), ctx: ctx, dryRun: dryRun, prev: map[string]*treeEntry{}, seen: map[string]bool{}}
+	var err error
+	b.k, err = r.keys(!dryRun)
+	if err != nil {
+		return b.t, nil, err
+	}
+	b.objects, err = r.objectSet()
+	if err != nil {
+		return b.t, nil, err
+	}
+	if base != "" {
+		prev, err := r.readTree(base)
+		if err != nil {
+			return b.t, nil, err
+		}
+		for i := range prev.Entries {
+			b.prev[prev.Entries[i].Path] = &prev.Entries[i]
+		}
+	}
+	b.source, err = filepath.EvalSymlinks(r.cfg.Source)
+	if err != nil {
+		return b.t, nil, fmt.Errorf("can not read %s: %v", r.cfg.Source, err)
+	}
+
+	r.warnRsyncOptions()
+	verb := "Storing"
+	if r.cfg.Encrypted {
+		verb = "Encrypting"
+	}
+	if dryRun {
+		r.logf("%s (dry run) %s to %s", verb, r.cfg.Source, r.displayPath(name))
+	} else {
+		r.logf("%s %s to %s", verb, r.cfg.Source, r.displayPath(name))
+	}
+	b.buf = make([]byte, CHUNK_MAX)
+	for _, root := range r.cfg.Roots {
+		b.root = filepath.Join(b.source, root)
+		if err := filepath.Walk(b.root, b.visit); err != nil {
+			if ctx.Err() != nil {
+				return b.t, b.errors, ctx.Err()
+			}
+			return b.t, b.errors, fmt.Errorf("can not read %s: %v", r.cfg.Source, err)
+		}
+	}
+
+	deleted := []string{}
+	for path := range b.prev {
+		if !b.seen[path] {
+			deleted = append(deleted, path)
+		}
+	}
+	sort.Strings(deleted)
+	for _, path := range deleted {
+		b.deleted(path)
+	}
+
+	if !dryRun {
+		sort.Slice(b.entries, func(i, j int) bool { return b.entries[i].Path < b.entries[j].Path })
+		if err := r.writeTree(b.k, name, date, &tree{Version: TREE_VERSION, Entries: b.entries}); err != nil {
+			return b.t, b.errors, err
+		}
+	}
+	return b.finish(dryRun)
+}
+
+func (b *chunkedBackup) visit(path string, info os.FileInfo, err error) error {
+	if cerr := b.ctx.Err(); cerr != nil {
+		return cerr
+	}
+	rel, _ := filepath.Rel(b.source, path)
+	if err != nil {
+		if path == b.root && info == nil {
+			return err
+		}
+		b.fail(rel, err)
+		return nil
+	}
+	if rel == "." {
+		return nil
+	}
+	if b.r.excluded(rel, info.IsDir()) {
+		return skipDir(info)
+	}
+
+	b.seen[rel] = true
+	b.t.Files++
+	st := info.Sys().(*syscall.Stat_t)
+	e := treeEntry{Path: filepath.ToSlash(rel), Mode: info.Mode(), Uid: st.Uid, Gid: st.Gid, ModTime: info.ModTime()}
+	switch {
+	case info.IsDir():
+	case (info.Mode() & os.ModeSymlink) != 0:
+		e.Target, err = os.Readlink(path)
+		if err != nil {
+			b.fail(rel, err)
+			return nil
+		}
+	case info.Mode().IsRegular():
+		e.Size = info.Size()
+		b.t.TotalSize += e.Size
+		if err := b.file(rel, path, &e); err != nil {
+			b.fail(rel, err)
+			return nil
+		}
+	default:
+		b.r.logf("skipping non-regular file %s", rel)
+		return nil
+	}
+	b.entries = append(b.entries, e)
+	return nil
+}
+
+// file splits the regular file path in chunks, storing the new ones
+func (b *chunkedBackup) file(rel, path string, e *treeEntry) error {
+	prev := b.prev[e.Path]
+	if prev != nil && prev.Mode == e.Mode && prev.Size == e.Size && prev.ModTime.Equal(e.ModTime) {
+		e.Objects, e.ChunkSizes = prev.Objects, prev.chunkSizes()
+		return nil
+	}
+
+	flags := ">f+++++++++"
+	if prev != nil {
+		flags = ">f.st......"
+	}
+	b.itemize(flags, e.Size, rel)
+	if prev == nil {
+		b.t.Created++
+	} else {
+		b.t.Updated++
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	e.Objects, e.ChunkSizes = []string{}, []int64{}
+	return readChunks(fh, b.k.gear, b.buf, func(chunk []byte) error {
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
+		id := b.k.id(chunk)
+		e.Objects = append(e.Objects, id)
+		e.ChunkSizes = append(e.ChunkSizes, int64(len(chunk)))
+		if b.objects[id] {
+			return nil
+		}
+		if !b.dryRun {
+			if err := b.r.writeObject(b.k, id, chunk); err != nil {
+				return err
+			}
+		}
+		b.objects[id] = true
+		b.t.TransferredSize += int64(len(chunk))
+		b.updateProgress(rel)
+		return nil
+	})
+}
+
+// sameContent returns true if the file sourcePath has the same content as
+// the chunks ids, which are read and checked against their id
+func (c *checker) sameContent(k *cryptKeys, sourcePath string, ids []string) bool {
+	fh, err := os.Open(sourcePath)
+	if err != nil {
+		c.r.logf("Error reading %s: %v", sourcePath, err)
+		return false
+	}
+	defer fh.Close()
+	rd := bufio.NewReader(fh)
+	var buf []byte
+	for _, id := range ids {
+		if c.ctx.Err() != nil {
+			return false
+		}
+		chunk, err := c.r.readObject(k, id)
+		if err != nil {
+			c.r.logf("Error reading chunk of %s: %v", sourcePath, err)
+			return false
+		}
+		if cap(buf) < len(chunk) {
+			buf = make([]byte, len(chunk))
+		}
+		if _, err := io.ReadFull(rd, buf[:len(chunk)]); err != nil || !bytes.Equal(buf[:len(chunk)], chunk) {
+			return false
+		}
+	}
+	_, err = rd.ReadByte()
+	return err == io.EOF
+}
+
+// checkChunked compares the tree of a snapshot in the chunks format with the
+// source directory, the contents of the files are compared with their chunks
+// which are checked against their id (and decrypted) on the way
+func (c *checker) checkChunked(date, subdir string) error {
+	r := c.r
+	c.res.Hash = "sha256"
+	if r.cfg.Encrypted {
+		c.res.Hash = "hmac-sha256"
+	}
+	k, err := r.keys(false)
+	if err != nil {
+		return err
+	}
+	t, err := r.readTree(date)
+	if err != nil {
+		return err
+	}
+	// the entries of every directory of the tree
+	dirs := map[string]map[string]os.FileInfo{}
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		dir := path.Dir(e.Path)
+		if dirs[dir] == nil {
+			dirs[dir] = map[string]os.FileInfo{}
+		}
+		dirs[dir][path.Base(e.Path)] = entryInfo{e}
+	}
+	backup := backupLister{
+		readDir: func(rel string) (map[string]os.FileInfo, error) {
+			files, ok := dirs[filepath.ToSlash(rel)]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+			return files, nil
+		},
+		readlink: func(rel string) (string, error) {
+			e := t.find(filepath.ToSlash(rel))
+			if e == nil {
+				return "", os.ErrNotExist
+			}
+			return e.Target, nil
+		},
+	}
+
+	return c.checkTree(subdir, backup, func(job checkJob) {
+		e := job.backupInfo.Sys().(*treeEntry)
+		c.res.Hashed++
+		c.res.Bytes += e.Size
+		if !c.sameContent(k, job.sourcePath, e.Objects) {
+			c.failure(job.sourcePath)
+		}
+	})
+}
+
+// verifyTree reads every chunk of the snapshot backup.<date>, in the chunks
+// format, checking that it matches its id
+func (r *Repository) verifyTree(ctx context.Context, date string) (*VerifyResult, error) {
+	k, err := r.keys(false)
+	if err != nil {
+		return nil, err
+	}
+	t, err := r.readTree(date)
+	if err != nil {
+		return nil, err
+	}
+	r.logf("Verifying %s%s", BACKUP_PREFIX, date)
+
+	res := &VerifyResult{Snapshot: date}
+	verified := map[string]error{}
+	for _, e := range t.Entries {
+		if !e.Mode.IsRegular() {
+			continue
+		}
+		res.Files++
+		for _, id := range e.Objects {
+			if err := ctx.Err(); err != nil {
+				return res, err
+			}
+			err, done := verified[id]
+			if !done {
+				_, err = r.readObject(k, id)
+				verified[id] = err
+			}
+			if err == nil {
+				continue
+			}
+			kind := "FAILED"
+			if os.IsNotExist(err) {
+				kind = "MISSING"
+			}
+			r.logf("%s %s: %v", kind, e.Path, err)
+			res.Problems = append(res.Problems, Problem{kind, e.Path})
+			break
+		}
+	}
+	return res, nil
+}
+
+// snapshotChunks returns the chunks used by the snapshot backup.<date> and
+// their size
+func (r *Repository) snapshotChunks(date string) (map[string]int64, error) {
+	t, err := r.readTree(date)
+	if err != nil {
+		return nil, err
+	}
+	chunks := map[string]int64{}
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		for j, sz := range e.chunkSizes() {
+			chunks[e.Objects[j]] = sz
+		}
+	}
+	return chunks, nil
+}
+
+// freedChunks computes how much space is freed by deleting each of the
+// snapshots in dates, in order. A chunk is only freed when the last snapshot
+// using it is deleted.
+func (r *Repository) freedChunks(dates []string) (map[string]int64, error) {
+	all, err := r.Dates()
+	if err != nil {
+		return nil, err
+	}
+	users := map[string]int{}
+	for _, date := range all {
+		chunks, err := r.snapshotChunks(date)
+		if err != nil {
+			return nil, err
+		}
+		for id := range chunks {
+			users[id]++
+		}
+	}
+	freed := map[string]int64{}
+	for _, date := range dates {
+		freed[date] = 0
+		chunks, err := r.snapshotChunks(date)
+		if err != nil {
+			return nil, err
+		}
+		for id, sz := range chunks {
+			users[id]--
+			if users[id] == 0 {
+				freed[date] += sz
+			}
+		}
+	}
+	return freed, nil
+}
+
+// collectGarbage removes the objects that are not used by any snapshot, and
+// the temporary files left behind by interrupted backups
+func (r *Repository) collectGarbage(ctx context.Context) error {
+	dates, err := r.Dates()
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, date := range dates {
+		chunks, err := r.snapshotChunks(date)
+		if err != nil {
+			return err
+		}
+		for id := range chunks {
+			used[id] = true
+		}
+	}
+
+	dirs, err := r.readDirNames(OBJECTS_DIR)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can not read %s: %v", r.displayPath(OBJECTS_DIR), err)
+	}
+	n := 0
+	for _, dir := range dirs {
+		names, err := r.readDirNames(OBJECTS_DIR + "/" + dir)
+		if err != nil {
+			return fmt.Errorf("can not read %s: %v", r.displayPath(OBJECTS_DIR+"/"+dir), err)
+		}
+		for _, name := range names {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if used[name] {
+				continue
+			}
+			name = OBJECTS_DIR + "/" + dir + "/" + name
+			if err := r.removeBackupFile(name); err != nil {
+				return fmt.Errorf("could not remove %s: %v", r.displayPath(name), err)
+			}
+			n++
+		}
+	}
+	r.logf("Removed %d unused chunks from %s", n, r.displayPath(OBJECTS_DIR))
+	return nil
+}
+
+// sizesChunked assigns every chunk to the oldest backup that uses it, each
+// file is listed under the backups that introduced some of its chunks
+func (r *Repository) sizesChunked(dates []string) (*SizeReport, error) {
+	rep := newSizeReport()
+	seen := map[string]bool{}
+	for _, date := range dates {
+		t, err := r.readTree(date)
+		if err != nil {
+			return nil, err
+		}
+		for i := range t.Entries {
+			e := &t.Entries[i]
+			sz := int64(0)
+			for j, csz := range e.chunkSizes() {
+				if !seen[e.Objects[j]] {
+					seen[e.Objects[j]] = true
+					sz += csz
+				}
+			}
+			if sz > 0 {
+				rep.add(date, sz, e.Path)
+			}
+		}
+	}
+	return rep, nil
+}
@@ -0,0 +1,93 @@
+package beck
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Files are cut into chunks where the content, rather than the offset,
+// says so: inserting or removing bytes in the middle of a file only changes
+// the chunks around the edit, all the others keep their id and are not
+// stored again. Chunks are between CHUNK_MIN and CHUNK_MAX bytes long, about
+// CHUNK_MIN+1MiB on average.
+const (
+	CHUNK_MIN = 256 * 1024
+	CHUNK_MAX = 8 * 1024 * 1024
+
+	// chunkMask selects the bits of the rolling hash that must be zero at
+	// the end of a chunk, the high bits depend on the last 64 bytes read
+	chunkMask = uint64(1<<20-1) << 44
+)
+
+// gearTable maps every byte to a random number for the rolling hash of
+// the chunker
+type gearTable [256]uint64
+
+// newGearTable returns the gear table of a backup directory, in encrypted
+// backup directories it depends on mac so that the size of the chunks
+// doesn't reveal anything about the content of the files
+func newGearTable(mac []byte) *gearTable {
+	var g gearTable
+	for i := range g {
+		msg := []byte{'b', 'e', 'c', 'k', ' ', 'g', 'e', 'a', 'r', byte(i)}
+		var sum []byte
+		if mac != nil {
+			h := hmac.New(sha256.New, mac)
+			h.Write(msg)
+			sum = h.Sum(nil)
+		} else {
+			s := sha256.Sum256(msg)
+			sum = s[:]
+		}
+		g[i] = binary.BigEndian.Uint64(sum)
+	}
+	return &g
+}
+
+// cut returns the length of the chunk at the start of buf, buf must be
+// shorter than CHUNK_MAX unless it is the end of the file
+func (g *gearTable) cut(buf []byte) int {
+	if len(buf) > CHUNK_MAX {
+		buf = buf[:CHUNK_MAX]
+	}
+	if len(buf) <= CHUNK_MIN {
+		return len(buf)
+	}
+	var h uint64
+	for i := CHUNK_MIN; i < len(buf); i++ {
+		h = h<<1 + g[buf[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(buf)
+}
+
+// readChunks reads rd calling fn for each chunk, buf must be CHUNK_MAX bytes
+// long
+func readChunks(rd io.Reader, g *gearTable, buf []byte, fn func(chunk []byte) error) error {
+	n := 0
+	eof := false
+	for {
+		if !eof && n < len(buf) {
+			m, err := io.ReadFull(rd, buf[n:])
+			n += m
+			switch {
+			case err == io.EOF || err == io.ErrUnexpectedEOF:
+				eof = true
+			case err != nil:
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		c := g.cut(buf[:n])
+		if err := fn(buf[:c]); err != nil {
+			return err
+		}
+		n = copy(buf, buf[c:n])
+	}
+}
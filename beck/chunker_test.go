@@ -0,0 +1,86 @@
+package beck
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// chunks returns the chunks data is cut into
+func chunks(t *testing.T, g *gearTable, data []byte) [][]byte {
+	r := [][]byte{}
+	buf := make([]byte, CHUNK_MAX)
+	err := readChunks(bytes.NewReader(data), g, buf, func(chunk []byte) error {
+		r = append(r, append([]byte(nil), chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.Join(r, nil), data) {
+		t.Fatalf("chunks of %d bytes do not add up to the data", len(data))
+	}
+	return r
+}
+
+func TestChunkCutPoints(t *testing.T) {
+	g := newGearTable(nil)
+	random := make([]byte, 12*1024*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name string
+		data []byte
+		// min is the minimum number of chunks, max the maximum
+		min, max int
+	}{
+		{"empty", nil, 0, 0},
+		{"short", random[:100], 1, 1},
+		{"minimum", random[:CHUNK_MIN], 1, 1},
+		{"random", random, 3, 12*1024*1024/CHUNK_MIN - 1},
+		{"zeros", make([]byte, 3*CHUNK_MAX+10), 4, 3*CHUNK_MAX/CHUNK_MIN + 1},
+	}
+	for _, tc := range tests {
+		r := chunks(t, g, tc.data)
+		if len(r) < tc.min || len(r) > tc.max {
+			t.Errorf("%s: %d chunks, expected between %d and %d", tc.name, len(r), tc.min, tc.max)
+		}
+		for i, chunk := range r {
+			if len(chunk) > CHUNK_MAX || (len(chunk) <= CHUNK_MIN && i != len(r)-1) {
+				t.Errorf("%s: chunk %d of %d is %d bytes long", tc.name, i, len(r), len(chunk))
+			}
+		}
+	}
+}
+
+// TestChunkEdit checks that an edit only changes the chunks around it
+func TestChunkEdit(t *testing.T) {
+	data := make([]byte, 12*1024*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	for _, mac := range [][]byte{nil, []byte("key")} {
+		g := newGearTable(mac)
+		orig := chunks(t, g, data)
+		pos := len(orig[0]) + len(orig[1]) + 1000
+		edited := append(append(append([]byte(nil), data[:pos]...), "inserted"...), data[pos:]...)
+		after := chunks(t, g, edited)
+
+		same := map[string]bool{}
+		for _, chunk := range orig {
+			same[string(chunk)] = true
+		}
+		changed := 0
+		for _, chunk := range after {
+			if !same[string(chunk)] {
+				changed++
+			}
+		}
+		if !bytes.Equal(after[0], orig[0]) || !bytes.Equal(after[1], orig[1]) || changed == 0 || changed > 2 {
+			t.Errorf("mac %q: %d of %d chunks changed", mac, changed, len(after))
+		}
+	}
+
+	if *newGearTable(nil) == *newGearTable([]byte("key")) {
+		t.Errorf("the gear table does not depend on the key")
+	}
+}
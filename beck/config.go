@@ -0,0 +1,344 @@
+package beck
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// profile is a backup job described in the config file
+type profile struct {
+	name         string
+	sources      []string
+	destination  string
+	exclude      []string
+	include      []string
+	rsyncOptions []string
+	retention    PrunePolicy
+	hookDir      string
+	schedule     string
+	engine       string
+	format       string
+	encrypted    bool
+	keyFile      string
+}
+
+// ConfigDir returns the directory containing the configuration of beck
+func ConfigDir() string {
+	config := os.Getenv("XDG_CONFIG_HOME")
+	if config == "" {
+		config = os.Getenv("HOME") + "/.config"
+	}
+	return config + "/beck/"
+}
+
+// readProfiles reads the config file, it is made of sections starting with
+// a "[profile name]" line, followed by "key value" lines:
+//
+//	source <directory>		can be repeated
+//	destination <directory or rsync:user@host:path>
+//	exclude <rsync pattern>		can be repeated
+//	include <rsync pattern>		can be repeated
+//	rsync-option <option>		can be repeated
+//	hooks <directory>		by default hooks/<profile name>
+//	schedule <schedule>		used by the daemon, see ParseSchedule
+//	engine <rsync or native>	see Config.Engine
+//	format <links or chunks>	see Config.Format
+//	encrypted <yes or no>		see Config.Encrypted
+//	key-file <path>			implies encrypted yes
+//	keep-<...> <value>		retention policy, see the prune command
+func readProfiles(path string) (map[string]*profile, error) {
+	r := map[string]*profile{}
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	defer fh.Close()
+
+	var cur *profile
+	var fs *flag.FlagSet
+	lineno := 0
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			cur = &profile{name: strings.TrimSpace(line[1 : len(line)-1])}
+			if _, ok := r[cur.name]; ok {
+				return nil, fmt.Errorf("%s:%d: duplicate profile %s", path, lineno, cur.name)
+			}
+			r[cur.name] = cur
+			fs = flag.NewFlagSet(cur.name, flag.ContinueOnError)
+			cur.retention.Flags(fs)
+			continue
+		}
+
+		if cur == nil {
+			return nil, fmt.Errorf("%s:%d: option outside of a profile", path, lineno)
+		}
+
+		// the key is separated from the value by any whitespace
+		key := strings.Fields(line)[0]
+		value := strings.TrimSpace(line[len(key):])
+		if value == "" {
+			return nil, fmt.Errorf("%s:%d: malformed line <%s>", path, lineno, line)
+		}
+
+		switch key {
+		case "source":
+			cur.sources = append(cur.sources, value)
+		case "destination":
+			cur.destination = value
+		case "exclude":
+			cur.exclude = append(cur.exclude, value)
+		case "include":
+			cur.include = append(cur.include, value)
+		case "rsync-option":
+			cur.rsyncOptions = append(cur.rsyncOptions, value)
+		case "hooks":
+			cur.hookDir = value
+		case "schedule":
+			cur.schedule = value
+		case "engine":
+			cur.engine = value
+		case "format":
+			cur.format = value
+		case "encrypted":
+			switch value {
+			case "yes":
+				cur.encrypted = true
+			case "no":
+				cur.encrypted = false
+			default:
+				return nil, fmt.Errorf("%s:%d: encrypted must be yes or no", path, lineno)
+			}
+		case "key-file":
+			cur.keyFile = value
+		default:
+			if !strings.HasPrefix(key, "keep-") {
+				return nil, fmt.Errorf("%s:%d: unknown option %s", path, lineno, key)
+			}
+			if err := fs.Set(key, value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return r, nil
+}
+
+func (p *profile) config() (Config, error) {
+	cfg := Config{Profile: p.name}
+	if len(p.sources) == 0 {
+		return cfg, fmt.Errorf("profile %s has no source", p.name)
+	}
+	if p.destination == "" {
+		return cfg, fmt.Errorf("profile %s has no destination", p.name)
+	}
+
+	// rsync runs in the source directory, relative paths would mean
+	// something different to it
+	for _, source := range p.sources {
+		if !filepath.IsAbs(source) {
+			return cfg, fmt.Errorf("profile %s: source %s must be an absolute path", p.name, source)
+		}
+	}
+	if !strings.HasPrefix(p.destination, RSYNC_PREFIX) && !filepath.IsAbs(p.destination) {
+		return cfg, fmt.Errorf("profile %s: destination %s must be an absolute path", p.name, p.destination)
+	}
+
+	if len(p.sources) == 1 {
+		cfg.Source = p.sources[0]
+	} else {
+		// with multiple sources the backup mirrors their absolute paths
+		cfg.Source = "/"
+		for _, source := range p.sources {
+			cfg.Roots = append(cfg.Roots, filepath.Clean(source)[1:])
+		}
+		cfg.RsyncOptions = append(cfg.RsyncOptions, "--relative")
+	}
+
+	cfg.Destination = p.destination
+	cfg.Exclude, cfg.Include = p.exclude, p.include
+	cfg.RsyncOptions = append(cfg.RsyncOptions, p.rsyncOptions...)
+	cfg.Retention = p.retention
+	cfg.Schedule = p.schedule
+	cfg.Engine = p.engine
+	cfg.Format = p.format
+	cfg.Encrypted = p.encrypted || p.keyFile != ""
+	cfg.KeyFile = p.keyFile
+	cfg.HookDir = p.hookDir
+	if cfg.HookDir == "" {
+		cfg.HookDir = ConfigDir() + "hooks/" + p.name
+	}
+	return cfg, nil
+}
+
+// LoadConfig reads the configuration of the named profile from the config
+// file in ConfigDir. If name is empty, or it is "default" and no such
+// profile exists, the legacy configuration is returned instead: ConfigDir
+// contains symbolic links to the source and backup directories (source and
+// backup), files of exclude and include patterns (exclude and include),
+// optionally a retention policy (prune), a directory of hooks (hooks), the
+// schedule of the daemon (schedule), the engine used to copy files (engine),
+// the format of the backup directory (format) and the key file of an
+// encrypted backup directory (key).
+func LoadConfig(name string) (Config, error) {
+	config := ConfigDir()
+
+	if name != "" {
+		profiles, err := readProfiles(config + "config")
+		if err != nil {
+			return Config{}, err
+		}
+		if p, ok := profiles[name]; ok {
+			return p.config()
+		}
+		if name != "default" {
+			return Config{}, fmt.Errorf("profile %s not found in %s", name, config+"config")
+		}
+	}
+
+	cfg := Config{
+		Source:      config + "source",
+		Destination: config + "backup",
+		ExcludeFrom: config + "exclude",
+		IncludeFrom: config + "include",
+		HookDir:     config + "hooks",
+	}
+
+	remote, err := readOptionalFile(config + "remote")
+	if err != nil {
+		return cfg, err
+	}
+	if remote != "" {
+		cfg.Destination = RSYNC_PREFIX + remote
+	} else if dest, err := os.Readlink(cfg.Destination); err == nil && strings.HasPrefix(dest, RSYNC_PREFIX) {
+		cfg.Destination = dest
+	}
+
+	for _, path := range []string{cfg.ExcludeFrom, cfg.IncludeFrom} {
+		if err := readableFile(path); err != nil {
+			return cfg, err
+		}
+	}
+	if err := validDirLink(cfg.Source); err != nil {
+		return cfg, err
+	}
+	if !strings.HasPrefix(cfg.Destination, RSYNC_PREFIX) {
+		// the directory it points to is checked by Open, it can be on a
+		// disk that is not always attached
+		if _, err := os.Readlink(cfg.Destination); err != nil {
+			return cfg, fmt.Errorf("%s is not a symbolic link", cfg.Destination)
+		}
+	}
+	if cfg.Schedule, err = readOptionalFile(config + "schedule"); err != nil {
+		return cfg, err
+	}
+	if cfg.Engine, err = readOptionalFile(config + "engine"); err != nil {
+		return cfg, err
+	}
+	if cfg.Format, err = readOptionalFile(config + "format"); err != nil {
+		return cfg, err
+	}
+	if _, err := os.Stat(config + "key"); err == nil {
+		cfg.Encrypted = true
+		cfg.KeyFile = config + "key"
+	} else if !os.IsNotExist(err) {
+		return cfg, fmt.Errorf("error reading %s: %v", config+"key", err)
+	}
+
+	cfg.Retention, err = readPrunePolicy(config + "prune")
+	return cfg, err
+}
+
+// readOptionalFile returns the contents of path without surrounding
+// whitespace, or an empty string if it does not exist
+func readOptionalFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func readableFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("can not read %s", path)
+	}
+	file.Close()
+	return nil
+}
+
+func validDirLink(path string) error {
+	entry, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("can not stat %s", path)
+	}
+
+	if (entry.Mode() & os.ModeSymlink) == 0 {
+		return fmt.Errorf("%s is not a symbolic link", path)
+	}
+
+	entry, err = os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("can not stat path linked by %s", path)
+	}
+
+	if (entry.Mode() & os.ModeDir) == 0 {
+		return fmt.Errorf("path linked by %s is not a directory", path)
+	}
+	return nil
+}
+
+// readPrunePolicy reads a retention policy file, one "keep-<something>
+// <value>" per line
+func readPrunePolicy(path string) (PrunePolicy, error) {
+	var p PrunePolicy
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	defer fh.Close()
+
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	p.Flags(fs)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		v := strings.Fields(line)
+		if len(v) != 2 {
+			return p, fmt.Errorf("could not parse %s: <%s>", path, line)
+		}
+		if err := fs.Set(v[0], v[1]); err != nil {
+			return p, fmt.Errorf("could not parse %s: <%s>: %v", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return p, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,187 @@
+package beck
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// CRYPT_NAME is the file, in the backup directory, that describes how the
+// keys of an encrypted backup directory are derived from the passphrase
+const CRYPT_NAME = "beck.crypt"
+
+// cryptParams is the content of CRYPT_NAME, Check lets us tell a wrong
+// passphrase from a corrupted backup
+type cryptParams struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Check   string `json:"check"`
+}
+
+// cryptKeys are the keys of a backup directory in the chunks format, aead
+// encrypts objects and trees, mac names objects after their contents and
+// gear decides where files are cut into chunks. Without encryption aead and
+// mac are nil, objects are named after their sha256 and stored as they are.
+type cryptKeys struct {
+	aead cipher.AEAD
+	mac  []byte
+	gear *gearTable
+}
+
+const cryptCheckString = "beck key check"
+
+func deriveKeys(secret []byte, p *cryptParams) (*cryptKeys, error) {
+	if p.KDF != "scrypt" {
+		return nil, fmt.Errorf("unknown key derivation function %q", p.KDF)
+	}
+	key, err := scrypt.Key(secret, p.Salt, p.N, p.R, p.P, 64)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	mac := key[32:]
+	return &cryptKeys{aead: aead, mac: mac, gear: newGearTable(mac)}, nil
+}
+
+// id returns the name of the object containing buf
+func (k *cryptKeys) id(buf []byte) string {
+	if k.mac == nil {
+		sum := sha256.Sum256(buf)
+		return hex.EncodeToString(sum[:])
+	}
+	h := hmac.New(sha256.New, k.mac)
+	h.Write(buf)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// seal encrypts buf, name is authenticated with it so that the server can not
+// swap two encrypted files
+func (k *cryptKeys) seal(name string, buf []byte) ([]byte, error) {
+	if k.aead == nil {
+		return buf, nil
+	}
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(buf)+k.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, buf, []byte(name)), nil
+}
+
+func (k *cryptKeys) open(name string, buf []byte) ([]byte, error) {
+	if k.aead == nil {
+		return buf, nil
+	}
+	if len(buf) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("%s: truncated", name)
+	}
+	n := k.aead.NonceSize()
+	out, err := k.aead.Open(nil, buf[:n], buf[n:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: decryption failed, the file is corrupted or was tampered with", name)
+	}
+	return out, nil
+}
+
+// secret returns the key file, or the passphrase if there is no key file
+func (r *Repository) secret(create bool) ([]byte, error) {
+	if r.cfg.KeyFile != "" {
+		b, err := ioutil.ReadFile(r.cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not read key file: %v", err)
+		}
+		b = bytes.TrimRight(b, "\r\n")
+		if len(b) == 0 {
+			return nil, fmt.Errorf("key file %s is empty", r.cfg.KeyFile)
+		}
+		return b, nil
+	}
+	if r.cfg.EncryptionPassphrase == nil {
+		return nil, fmt.Errorf("the backup directory is encrypted, a key file or a passphrase is needed")
+	}
+	pass, err := r.cfg.EncryptionPassphrase(create)
+	if err != nil {
+		return nil, err
+	}
+	if pass == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return []byte(pass), nil
+}
+
+// keys returns the keys of the backup directory, if it is encrypted, create
+// is set and the backup directory has no CRYPT_NAME file a new one is written
+func (r *Repository) keys(create bool) (*cryptKeys, error) {
+	if r.ckeys != nil {
+		return r.ckeys, nil
+	}
+	if !r.cfg.Encrypted {
+		r.ckeys = &cryptKeys{gear: newGearTable(nil)}
+		return r.ckeys, nil
+	}
+
+	var p cryptParams
+	fh, err := r.openBackupFile(CRYPT_NAME)
+	switch {
+	case err == nil:
+		err = json.NewDecoder(fh).Decode(&p)
+		fh.Close()
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s: %v", CRYPT_NAME, err)
+		}
+	case os.IsNotExist(err) && create:
+		p = cryptParams{Version: 1, KDF: "scrypt", N: 1 << 15, R: 8, P: 1, Salt: make([]byte, 32)}
+		if _, err := io.ReadFull(rand.Reader, p.Salt); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("%s is not an encrypted backup directory (%s not found)", r.cfg.Destination, CRYPT_NAME)
+	default:
+		return nil, fmt.Errorf("can not read %s: %v", r.displayPath(CRYPT_NAME), err)
+	}
+
+	secret, err := r.secret(p.Check == "")
+	if err != nil {
+		return nil, err
+	}
+	k, err := deriveKeys(secret, &p)
+	if err != nil {
+		return nil, err
+	}
+	check := k.id([]byte(cryptCheckString))
+	if p.Check == "" {
+		p.Check = check
+		buf, err := json.MarshalIndent(&p, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		r.logf("Initializing encrypted backup directory %s", r.cfg.Destination)
+		if err := r.writeBackupFile(CRYPT_NAME, os.O_CREATE|os.O_EXCL, append(buf, '\n')); err != nil {
+			return nil, err
+		}
+	} else if !hmac.Equal([]byte(check), []byte(p.Check)) {
+		return nil, fmt.Errorf("wrong passphrase or key file for %s", r.cfg.Destination)
+	}
+	r.ckeys = k
+	return k, nil
+}
@@ -0,0 +1,213 @@
+package beck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// DaemonOptions are the options of RunDaemon
+type DaemonOptions struct {
+	Schedule Schedule
+	// Retry is how long to wait before trying again when the backup
+	// directory can not be reached or a backup fails, by default 10 minutes
+	Retry time.Duration
+	// Backup are the options used for every backup
+	Backup BackupOptions
+	// StatusPath is the file where the state of the daemon is written, by
+	// default StatusPath(cfg.Profile)
+	StatusPath string
+}
+
+// DaemonStatus is the state of a daemon, as written to its status file
+type DaemonStatus struct {
+	PID      int       `json:"pid"`
+	Started  time.Time `json:"started"`
+	Schedule string    `json:"schedule"`
+	// State is "waiting" for the next backup, "running" a backup,
+	// "unreachable" if the backup directory could not be accessed or
+	// "stopped"
+	State string `json:"state"`
+	// LastBackup is the timestamp of the newest backup
+	LastBackup string `json:"last_backup,omitempty"`
+	// LastRun is when the daemon last started a backup
+	LastRun time.Time `json:"last_run"`
+	// LastError is the last error of the daemon, cleared by the next
+	// successful backup
+	LastError string    `json:"last_error,omitempty"`
+	NextRun   time.Time `json:"next_run"`
+	Updated   time.Time `json:"updated"`
+}
+
+// StatusPath returns the default path of the status file of the daemon
+// running profile
+func StatusPath(profile string) string {
+	if profile == "" {
+		return ConfigDir() + "status"
+	}
+	return ConfigDir() + "status." + profile
+}
+
+// ReadDaemonStatus reads a status file written by RunDaemon
+func ReadDaemonStatus(path string) (*DaemonStatus, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var st DaemonStatus
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("malformed status file %s: %v", path, err)
+	}
+	return &st, nil
+}
+
+// Running returns true if the daemon that wrote the status is still running
+func (st *DaemonStatus) Running() bool {
+	if st.State == "stopped" {
+		return false
+	}
+	start, ok := processStartTime(st.PID)
+	if !ok {
+		return false
+	}
+	d := start.Sub(st.Started)
+	return d > -time.Minute && d < time.Minute
+}
+
+func writeDaemonStatus(path string, st *DaemonStatus) error {
+	st.Updated = time.Now()
+	b, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// newestBackup returns the timestamp and time of the newest backup in the
+// backup directory of cfg, the zero time if there are no backups
+func newestBackup(cfg Config) (string, time.Time, error) {
+	repo, err := Open(cfg)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer repo.Close()
+	dates, err := repo.Dates()
+	if err != nil || len(dates) == 0 {
+		return "", time.Time{}, err
+	}
+	last := dates[len(dates)-1]
+	return last, parseBackupDate(last), nil
+}
+
+// sleepUntil waits until the wall clock reaches t, the clock is checked every
+// minute so that time spent suspended is noticed
+func sleepUntil(ctx context.Context, t time.Time) error {
+	t = t.Round(0)
+	for {
+		d := time.Until(t)
+		if d <= 0 {
+			return nil
+		}
+		if d > time.Minute {
+			d = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+}
+
+func runScheduledBackup(ctx context.Context, cfg Config, opts BackupOptions) (*BackupResult, error) {
+	repo, err := Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	return repo.Backup(ctx, opts)
+}
+
+// RunDaemon makes backups of cfg following opts.Schedule until ctx is
+// cancelled. The time of the next backup is computed from the newest backup
+// in the backup directory, so that backups missed while the computer was
+// off or suspended are made as soon as possible. If the backup directory
+// can not be reached, or the backup fails, it is tried again after
+// opts.Retry.
+func RunDaemon(ctx context.Context, cfg Config, opts DaemonOptions) error {
+	if opts.Schedule.Every <= 0 && len(opts.Schedule.At) == 0 {
+		return fmt.Errorf("no schedule")
+	}
+	if opts.Retry <= 0 {
+		opts.Retry = 10 * time.Minute
+	}
+	if opts.StatusPath == "" {
+		opts.StatusPath = StatusPath(cfg.Profile)
+	}
+	if st, err := ReadDaemonStatus(opts.StatusPath); err == nil && st.Running() {
+		return fmt.Errorf("daemon already running (pid %d)", st.PID)
+	}
+
+	st := &DaemonStatus{PID: os.Getpid(), Started: time.Now(), Schedule: opts.Schedule.String()}
+	update := func(state string) {
+		st.State = state
+		if err := writeDaemonStatus(opts.StatusPath, st); err != nil {
+			printLog(cfg.Logger, "Could not write status file: %v", err)
+		}
+	}
+	defer update("stopped")
+
+	var retryAt time.Time
+	for {
+		date, last, err := newestBackup(cfg)
+		if err != nil {
+			printLog(cfg.Logger, "Backup directory not reachable, trying again in %v: %v", opts.Retry, err)
+			st.LastError = err.Error()
+			st.NextRun = time.Now().Add(opts.Retry).Round(0)
+			update("unreachable")
+			if err := sleepUntil(ctx, st.NextRun); err != nil {
+				return nil
+			}
+			continue
+		}
+
+		st.LastBackup = date
+		next := opts.Schedule.Next(last)
+		if retryAt.After(next) {
+			next = retryAt
+		}
+		st.NextRun = next
+		update("waiting")
+		if next.After(time.Now()) {
+			printLog(cfg.Logger, "Next backup at %s", next.Format("2006-01-02 15:04:05"))
+		} else if !last.IsZero() {
+			printLog(cfg.Logger, "Backup due since %s", next.Format("2006-01-02 15:04:05"))
+		}
+		if err := sleepUntil(ctx, next); err != nil {
+			return nil
+		}
+
+		st.LastRun = time.Now().Round(0)
+		update("running")
+		res, err := runScheduledBackup(ctx, cfg, opts.Backup)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			printLog(cfg.Logger, "Backup failed, trying again in %v: %v", opts.Retry, err)
+			st.LastError = err.Error()
+			retryAt = time.Now().Add(opts.Retry).Round(0)
+			continue
+		}
+		st.LastBackup = res.Snapshot
+		st.LastError = ""
+		retryAt = time.Time{}
+	}
+}
@@ -0,0 +1,206 @@
+package beck
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// DiffOptions are the options of Repository.Diff
+type DiffOptions struct {
+	// From and To are the backups to compare (see Resolve), To is the latest
+	// backup by default
+	From, To string
+	// Source compares From with the source directory instead of a backup
+	Source bool
+}
+
+// Change is a difference between two versions of a path, Kind is "+" if
+// the path was added, "-" if it was removed, "M" if its contents changed
+// and "m" if only its metadata changed
+type Change struct {
+	Kind string
+	Path string
+}
+
+// walkTree returns the lstat of every entry under dir, indexed by the path
+// relative to dir, skipping the paths for which excluded (if not nil)
+// returns true
+func walkTree(ctx context.Context, dir string, roots []string, excluded func(rel string, isDir bool) bool) (map[string]os.FileInfo, error) {
+	r := map[string]os.FileInfo{}
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can not read %s: %v", dir, err)
+	}
+	for _, root := range roots {
+		err = filepath.Walk(filepath.Join(dir, root), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if path == dir {
+				return nil
+			}
+			// dir is "/" for profiles with multiple sources
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			if excluded != nil && excluded(rel, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			r[rel] = info
+			return nil
+		})
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil && !(os.IsNotExist(err) && root != ".") {
+			return nil, fmt.Errorf("can not read %s: %v", dir, err)
+		}
+	}
+	return r, nil
+}
+
+func sameMetadata(a, b os.FileInfo) bool {
+	sta, stb := a.Sys().(*syscall.Stat_t), b.Sys().(*syscall.Stat_t)
+	if a.Mode() != b.Mode() || sta.Uid != stb.Uid || sta.Gid != stb.Gid {
+		return false
+	}
+	// the modification time of directories changes every time something is
+	// added or removed, it's just noise
+	return a.IsDir() || a.ModTime().Equal(b.ModTime())
+}
+
+// diffEntry compares two versions of the same path, returns "" if they are
+// the same, "M" if the contents changed and "m" if only metadata changed
+func diffEntry(algo hashAlgo, pathA, pathB string, a, b os.FileInfo, buf []byte) string {
+	if (a.Mode() & os.ModeType) != (b.Mode() & os.ModeType) {
+		return "M"
+	}
+
+	switch {
+	case (a.Mode() & os.ModeSymlink) != 0:
+		ta, _ := os.Readlink(pathA)
+		tb, _ := os.Readlink(pathB)
+		if ta != tb {
+			return "M"
+		}
+	case (a.Mode() & os.ModeType) == 0:
+		if os.SameFile(a, b) {
+			// hard linked by --link-dest
+			return ""
+		}
+		if a.Size() != b.Size() {
+			return "M"
+		}
+		if sameMetadata(a, b) {
+			// rsync would not have transferred it either
+			return ""
+		}
+		ha, erra := checksum(algo, pathA, buf)
+		hb, errb := checksum(algo, pathB, buf)
+		if erra != nil || errb != nil || ha != hb {
+			return "M"
+		}
+	}
+
+	if !sameMetadata(a, b) {
+		return "m"
+	}
+	return ""
+}
+
+// Diff compares two backups, or a backup and the source directory, only
+// local backups are supported
+func (r *Repository) Diff(ctx context.Context, opts DiffOptions) ([]Change, error) {
+	if err := r.notChunked("diff"); err != nil {
+		return nil, err
+	}
+	if r.remote {
+		return nil, fmt.Errorf("can not diff remote backups")
+	}
+
+	dates, err := r.Dates()
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(spec string) (string, error) {
+		date, err := resolveSnapshot(dates, spec)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", r.cfg.Destination, err)
+		}
+		return r.dir(BACKUP_PREFIX + date), nil
+	}
+
+	dirA, err := resolve(opts.From)
+	if err != nil {
+		return nil, err
+	}
+	dirB := r.cfg.Source
+	if !opts.Source {
+		dirB, err = resolve(opts.To)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.logf("Comparing %s with %s", dirA, dirB)
+
+	roots := []string{"."}
+	var excluded func(string, bool) bool
+	if opts.Source {
+		// like rsync, ignore what the exclude rules leave out of backups
+		roots, excluded = r.cfg.Roots, r.excluded
+	}
+	treeA, err := walkTree(ctx, dirA, roots, nil)
+	if err != nil {
+		return nil, err
+	}
+	treeB, err := walkTree(ctx, dirB, roots, excluded)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(treeA)+len(treeB))
+	for path := range treeA {
+		paths = append(paths, path)
+	}
+	for path := range treeB {
+		if _, ok := treeA[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	algo, _ := hashByName(DefaultHash)
+	buf := make([]byte, 64*1024)
+	changes := []Change{}
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		a, inA := treeA[path]
+		b, inB := treeB[path]
+		var d string
+		switch {
+		case !inA:
+			d = "+"
+		case !inB:
+			d = "-"
+		default:
+			d = diffEntry(algo, dirA+"/"+path, dirB+"/"+path, a, b, buf)
+		}
+		if d != "" {
+			changes = append(changes, Change{d, path})
+		}
+	}
+	return changes, nil
+}
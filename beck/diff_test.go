@@ -0,0 +1,65 @@
+package beck
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestDiffSource checks diff -source on a profile with multiple sources,
+// where the source directory is "/" and the roots are absolute paths
+func TestDiffSource(t *testing.T) {
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, bk := filepath.Join(tmp, "src"), filepath.Join(tmp, "bk")
+	for _, dir := range []string{filepath.Join(src, "sub"), bk} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub/a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := src[1:]
+	r, err := Open(Config{
+		Source:      "/",
+		Roots:       []string{root},
+		Destination: bk,
+		Engine:      ENGINE_NATIVE,
+		Stdout:      ioutil.Discard,
+		Logger:      log.New(ioutil.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Backup(context.Background(), BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	diff := func() []Change {
+		changes, err := r.Diff(context.Background(), DiffOptions{From: "latest", Source: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return changes
+	}
+	if changes := diff(); len(changes) != 0 {
+		t.Errorf("source not changed, got %v", changes)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(src, "sub/b"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{{"+", filepath.Join(root, "sub/b")}}
+	if changes := diff(); !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %v, expected %v", changes, want)
+	}
+}
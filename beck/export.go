@@ -0,0 +1,366 @@
+package beck
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ExportOptions are the options of Repository.Export
+type ExportOptions struct {
+	// Snapshot is the backup to export (see Resolve), by default the latest
+	Snapshot string
+	// Subdir is a subdirectory of the backup, only it is exported
+	Subdir string
+	// Gzip compresses the archive
+	Gzip bool
+}
+
+// ImportOptions are the options of Repository.Import
+type ImportOptions struct {
+	// Snapshot is the timestamp of the imported backup, by default the one
+	// of the exported backup
+	Snapshot string
+	// Wait is how long to wait for other instances of beck using the same
+	// backup directory
+	Wait time.Duration
+}
+
+// cleanSubdir turns subdir into a relative path that does not leave the
+// directory it is relative to
+func cleanSubdir(subdir string) string {
+	subdir = path.Clean("/" + subdir)[1:]
+	if subdir == "" {
+		return "."
+	}
+	return subdir
+}
+
+// Export writes backup opts.Snapshot to w as a tar archive, all paths in the
+// archive are inside a backup.<timestamp> directory. Permissions, ownership,
+// modification times, symbolic links and hard links between files of the
+// backup are preserved.
+func (r *Repository) Export(ctx context.Context, w io.Writer, opts ExportOptions) error {
+	if err := r.notChunked("export"); err != nil {
+		return err
+	}
+	date, err := r.Resolve(opts.Snapshot)
+	if err != nil {
+		return err
+	}
+	subdir := cleanSubdir(opts.Subdir)
+	top := BACKUP_PREFIX + date
+
+	var gzw *gzip.Writer
+	if opts.Gzip {
+		gzw = gzip.NewWriter(w)
+		w = gzw
+	}
+
+	r.logf("Exporting %s", r.displayPath(path.Join(top, subdir)))
+	if r.remote {
+		err = r.cmdStreamRemote(ctx, nil, w, "tar", "--numeric-owner", "-C", shellQuote(r.path), "-cf", "-", shellQuote(path.Join(top, subdir)))
+	} else {
+		err = exportTar(ctx, w, r.dir(top), top, subdir)
+	}
+	if err != nil {
+		return fmt.Errorf("could not export %s: %v", top, err)
+	}
+	if gzw != nil {
+		return gzw.Close()
+	}
+	return nil
+}
+
+// exportTar writes subdir of the local directory dir to w as a tar archive,
+// with paths starting with top
+func exportTar(ctx context.Context, w io.Writer, dir, top, subdir string) error {
+	tw := tar.NewWriter(w)
+	links := map[fileId]string{}
+	err := filepath.Walk(filepath.Join(dir, subdir), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := top
+		if p != dir {
+			name = path.Join(top, filepath.ToSlash(p[len(dir)+1:]))
+		}
+
+		target := ""
+		if (info.Mode() & os.ModeSymlink) != 0 {
+			target, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, target)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		st := info.Sys().(*syscall.Stat_t)
+		if info.Mode().IsRegular() && st.Nlink > 1 {
+			id := fileId{uint64(st.Dev), uint64(st.Ino)}
+			if first, ok := links[id]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[id] = name
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			return nil
+		}
+		fh, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		_, err = io.Copy(tw, fh)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// openArchive returns a reader of the uncompressed tar archive read from rd
+// and the name of the first directory in it
+func openArchive(rd io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReader(rd)
+	var in io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		in = gzr
+	}
+
+	// read the first header, then put back what was read
+	var buf bytes.Buffer
+	hdr, err := tar.NewReader(io.TeeReader(in, &buf)).Next()
+	if err != nil {
+		return nil, "", fmt.Errorf("not a tar archive: %v", err)
+	}
+	top := strings.SplitN(path.Clean(hdr.Name), "/", 2)[0]
+	return io.MultiReader(&buf, in), top, nil
+}
+
+// importTar extracts the tar archive read from rd into dir, the first
+// component of all paths in the archive (top) is removed
+func importTar(ctx context.Context, rd io.Reader, dir, top string) error {
+	// permissions and modification times of directories are set at the end,
+	// after they have been filled
+	dirs := []*tar.Header{}
+	dirPaths := []string{}
+
+	local := func(name string) (string, error) {
+		name = path.Clean(name)
+		if name == top {
+			return dir, nil
+		}
+		if !strings.HasPrefix(name, top+"/") {
+			return "", fmt.Errorf("%s is outside of %s", name, top)
+		}
+		return filepath.Join(dir, filepath.FromSlash(cleanSubdir(name[len(top)+1:]))), nil
+	}
+
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p, err := local(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := noSymlinks(dir, p); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+			dirPaths = append(dirPaths, p)
+			continue
+		case tar.TypeReg:
+			fh, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(fh, tr)
+			if cerr := fh.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, p); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := local(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := noSymlinks(dir, target); err != nil {
+				return err
+			}
+			if info, err := os.Lstat(target); err != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("%s: hard link target %s is not a file of the archive", hdr.Name, hdr.Linkname)
+			}
+			if err := os.Link(target, p); err != nil {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("%s: unsupported file type %c", hdr.Name, hdr.Typeflag)
+		}
+
+		if err := setHeaderMetadata(p, hdr); err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setHeaderMetadata(dirPaths[i], dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noSymlinks returns an error if p, or one of the directories between dir
+// and p, is a symbolic link: an archive could create one pointing outside of
+// dir and then write through it
+func noSymlinks(dir, p string) error {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || outsideDir(rel) {
+		return fmt.Errorf("%s is outside of %s", p, dir)
+	}
+	if rel == "." {
+		return nil
+	}
+	cur := dir
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, c)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if (info.Mode() & os.ModeSymlink) != 0 {
+			return fmt.Errorf("%s goes through the symbolic link %s", p, cur)
+		}
+	}
+	return nil
+}
+
+// setHeaderMetadata sets owner, permissions and modification time of p to
+// those of hdr
+func setHeaderMetadata(p string, hdr *tar.Header) error {
+	return setMetadata(p, hdr.Uid, hdr.Gid, hdr.FileInfo().Mode(), hdr.ModTime)
+}
+
+// Import reads a tar archive written by Export (optionally compressed with
+// gzip) and adds it to the repository as a new backup, returns its
+// timestamp.
+func (r *Repository) Import(ctx context.Context, rd io.Reader, opts ImportOptions) (string, error) {
+	if err := r.notChunked("import"); err != nil {
+		return "", err
+	}
+	in, top, err := openArchive(rd)
+	if err != nil {
+		return "", err
+	}
+
+	date := opts.Snapshot
+	if date == "" {
+		var ok bool
+		date, ok = backupDateOf(top)
+		if !ok {
+			return "", fmt.Errorf("%s is not a backup directory, specify the timestamp of the imported backup", top)
+		}
+	} else if _, ok := backupDateOf(BACKUP_PREFIX + date); !ok {
+		return "", fmt.Errorf("malformed timestamp %q", date)
+	}
+
+	release, err := r.acquireLock(ctx, opts.Wait)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	dates, err := r.Dates()
+	if err != nil {
+		return "", err
+	}
+	for _, d := range dates {
+		if d == date {
+			return "", fmt.Errorf("backup %s already exists", r.displayPath(BACKUP_PREFIX+date))
+		}
+	}
+
+	name := BACKUP_PREFIX + date
+	work := name + IMPORT_SUFFIX
+	r.logf("Importing %s as %s", top, r.displayPath(name))
+	if r.remote {
+		err = r.cmdStreamRemote(ctx, in, r.cfg.Stdout, "mkdir", shellQuote(r.dir(work)), "&&", "tar", "--numeric-owner", "--strip-components=1", "-C", shellQuote(r.dir(work)), "-xpf", "-")
+	} else {
+		err = os.Mkdir(r.dir(work), 0755)
+		if err == nil {
+			err = importTar(ctx, in, r.dir(work), top)
+		}
+	}
+	if err != nil {
+		if rerr := r.removeBackupDir(ctx, false, work); rerr != nil {
+			r.logf("%v", rerr)
+		}
+		return "", fmt.Errorf("could not import %s: %v", top, err)
+	}
+	if err := r.renameBackupDir(ctx, false, work, name); err != nil {
+		return "", err
+	}
+	r.tryWriteManifest(ctx, date, "")
+	return date, nil
+}
@@ -0,0 +1,170 @@
+package beck
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExportImportTar(t *testing.T) {
+	tmp := t.TempDir()
+	src, dst := filepath.Join(tmp, "src"), filepath.Join(tmp, "dst")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err := os.MkdirAll(filepath.Join(src, "dir/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := []struct {
+		name, content string
+		mode          os.FileMode
+	}{
+		{"a", "first file", 0644},
+		{"dir/b", "second file", 0600},
+		{"dir/sub/x", "executable", 0755},
+	}
+	for _, f := range files {
+		p := filepath.Join(src, f.name)
+		if err := ioutil.WriteFile(p, []byte(f.content), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, "dir/hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../a", filepath.Join(src, "dir/symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "dir/sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "dir/b", "dir/sub/x", "dir/sub", "dir"} {
+		if err := os.Chtimes(filepath.Join(src, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := exportTar(context.Background(), &archive, src, "backup.20200102030405", "."); err != nil {
+		t.Fatal(err)
+	}
+	in, top, err := openArchive(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if top != "backup.20200102030405" {
+		t.Errorf("top directory of the archive is %q", top)
+	}
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := importTar(context.Background(), in, dst, top); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		p := filepath.Join(dst, f.name)
+		b, err := ioutil.ReadFile(p)
+		if err != nil || string(b) != f.content {
+			t.Errorf("%s: got %q %v, expected %q", f.name, b, err, f.content)
+			continue
+		}
+		info, _ := os.Stat(p)
+		if info.Mode() != f.mode || !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: got %v %v, expected %v %v", f.name, info.Mode(), info.ModTime(), f.mode, mtime)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "dir/sub")); err != nil || info.Mode() != os.ModeDir|0700 || !info.ModTime().Equal(mtime) {
+		t.Errorf("dir/sub: got %v, %v", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "dir/symlink")); err != nil || target != "../a" {
+		t.Errorf("dir/symlink: got %q %v", target, err)
+	}
+	a, _ := os.Stat(filepath.Join(dst, "a"))
+	link, _ := os.Stat(filepath.Join(dst, "dir/hardlink"))
+	if a == nil || link == nil || a.Sys().(*syscall.Stat_t).Ino != link.Sys().(*syscall.Stat_t).Ino {
+		t.Errorf("dir/hardlink is not a hard link to a")
+	}
+}
+
+// TestImportTarEscape checks that archives can not write outside of the
+// directory they are imported into
+func TestImportTarEscape(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tar.Header
+	}{
+		{"write through symlink", []tar.Header{
+			{Name: "top/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "top/l", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "top/l/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		}},
+		{"replace symlink", []tar.Header{
+			{Name: "top/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "top/l", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE/evil"},
+			{Name: "top/l", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		}},
+		{"hard link through symlink", []tar.Header{
+			{Name: "top/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "top/l", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "top/evil", Typeflag: tar.TypeLink, Linkname: "top/l/secret"},
+		}},
+		{"hard link outside", []tar.Header{
+			{Name: "top/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "top/evil", Typeflag: tar.TypeLink, Linkname: "OUTSIDE/secret"},
+		}},
+		{"dot dot", []tar.Header{
+			{Name: "top/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "top/../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		}},
+	}
+	for _, tc := range tests {
+		tmp := t.TempDir()
+		dst, outside := filepath.Join(tmp, "dst"), filepath.Join(tmp, "outside")
+		for _, dir := range []string{dst, outside} {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		for _, hdr := range tc.entries {
+			hdr.Linkname = strings.Replace(hdr.Linkname, "OUTSIDE", outside, 1)
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Size > 0 {
+				tw.Write([]byte("evil"))
+			}
+		}
+		tw.Close()
+
+		if err := importTar(context.Background(), &archive, dst, "top"); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+		for _, p := range []string{filepath.Join(outside, "evil"), filepath.Join(tmp, "evil")} {
+			if _, err := os.Lstat(p); err == nil {
+				t.Errorf("%s: %s was created", tc.name, p)
+			}
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(outside, "secret")); err != nil || string(b) != "secret" {
+			t.Errorf("%s: secret was modified: %q %v", tc.name, b, err)
+		}
+		if info, err := os.Stat(filepath.Join(outside, "secret")); err == nil && info.Sys().(*syscall.Stat_t).Nlink != 1 {
+			t.Errorf("%s: secret was linked", tc.name)
+		}
+	}
+}
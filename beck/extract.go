@@ -0,0 +1,154 @@
+package beck
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractOptions are the options of Repository.Extract
+type ExtractOptions struct {
+	// Path is the file or directory to extract, either relative to the
+	// source directory or an absolute path inside it, by default everything
+	Path string
+	// At is the backup to extract from (see Resolve), by default the latest
+	At string
+	// To is the directory where Path is extracted
+	To string
+	// Force overwrites existing files
+	Force bool
+}
+
+// Extract reassembles (and decrypts) a file or directory of a backup of a
+// backup directory in the chunks format, writing it to ExtractOptions.To.
+// Returns the number of regular files extracted.
+func (r *Repository) Extract(ctx context.Context, opts ExtractOptions) (int, error) {
+	if !r.chunked() {
+		return 0, fmt.Errorf("%s is not in the %s format, use restore", r.cfg.Destination, FORMAT_CHUNKS)
+	}
+	if opts.To == "" {
+		return 0, fmt.Errorf("no destination directory")
+	}
+	rel := "."
+	if opts.Path != "" {
+		var err error
+		rel, err = r.sourceRelative(opts.Path)
+		if err != nil {
+			return 0, err
+		}
+	}
+	rel = filepath.ToSlash(rel)
+
+	date, err := r.Resolve(opts.At)
+	if err != nil {
+		return 0, err
+	}
+	k, err := r.keys(false)
+	if err != nil {
+		return 0, err
+	}
+	t, err := r.readTree(date)
+	if err != nil {
+		return 0, err
+	}
+
+	// the entries to extract and where, Path itself is extracted to
+	// To/<base name of Path>
+	entries := []*treeEntry{}
+	dests := []string{}
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		switch {
+		case rel == ".":
+			dests = append(dests, filepath.Join(opts.To, filepath.FromSlash(e.Path)))
+		case e.Path == rel || strings.HasPrefix(e.Path, rel+"/"):
+			dests = append(dests, filepath.Join(opts.To, filepath.FromSlash(path.Base(rel)+e.Path[len(rel):])))
+		default:
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return 0, fmt.Errorf("%s not found in %s%s", rel, BACKUP_PREFIX, date)
+	}
+
+	r.logf("Extracting %s from %s%s to %s", rel, BACKUP_PREFIX, date, opts.To)
+	files := 0
+	for i, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return files, err
+		}
+		if err := r.extractEntry(k, e, dests[i], opts.Force); err != nil {
+			return files, fmt.Errorf("could not extract %s: %v", e.Path, err)
+		}
+		if e.Mode.IsRegular() {
+			files++
+		}
+	}
+
+	// directories are filled before their permissions and modification time
+	// are set
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Mode.IsDir() {
+			if err := setTreeMetadata(dests[i], entries[i]); err != nil {
+				return files, fmt.Errorf("could not extract %s: %v", entries[i].Path, err)
+			}
+		}
+	}
+	return files, nil
+}
+
+func (r *Repository) extractEntry(k *cryptKeys, e *treeEntry, dest string, force bool) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if e.Mode.IsDir() {
+		return os.MkdirAll(dest, 0700)
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		if !force {
+			return fmt.Errorf("%s already exists", dest)
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+	}
+
+	if (e.Mode & os.ModeSymlink) != 0 {
+		if err := os.Symlink(e.Target, dest); err != nil {
+			return err
+		}
+		return setTreeMetadata(dest, e)
+	}
+
+	fh, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	for _, id := range e.Objects {
+		var chunk []byte
+		chunk, err = r.readObject(k, id)
+		if err == nil {
+			_, err = fh.Write(chunk)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return setTreeMetadata(dest, e)
+}
+
+// setTreeMetadata sets owner, permissions and modification time of p to
+// those of e
+func setTreeMetadata(p string, e *treeEntry) error {
+	return setMetadata(p, int(e.Uid), int(e.Gid), e.Mode, e.ModTime)
+}
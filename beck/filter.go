@@ -0,0 +1,231 @@
+package beck
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// filterRule is an rsync include/exclude pattern
+type filterRule struct {
+	include bool
+	re      *regexp.Regexp
+	dirOnly bool
+	// full is true if the pattern is matched against the full path instead
+	// of just the last component
+	full bool
+}
+
+// compileFilterRule converts an rsync pattern to a filterRule, patterns
+// starting with "+ " or "- " override include
+func compileFilterRule(include bool, pattern string) (filterRule, error) {
+	if strings.HasPrefix(pattern, "+ ") {
+		include, pattern = true, pattern[2:]
+	} else if strings.HasPrefix(pattern, "- ") {
+		include, pattern = false, pattern[2:]
+	}
+
+	r := filterRule{include: include}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimLeft(pattern, "/")
+	r.full = anchored || strings.Contains(pattern, "/") || strings.Contains(pattern, "**")
+
+	contents := false
+	if strings.HasSuffix(pattern, "/***") {
+		// matches the directory and everything inside it
+		contents = true
+		pattern = pattern[:len(pattern)-len("/***")]
+	}
+
+	var rx bytes.Buffer
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				rx.WriteString(".*")
+				i++
+			} else {
+				rx.WriteString("[^/]*")
+			}
+		case '?':
+			rx.WriteString("[^/]")
+		case '[':
+			class, n := bracketClass(pattern[i:])
+			if n == 0 {
+				rx.WriteString("\\[")
+				break
+			}
+			rx.WriteString(class)
+			i += n - 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			rx.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			rx.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if contents {
+		rx.WriteString("(/.*)?")
+	}
+
+	var err error
+	switch {
+	case anchored || !r.full:
+		r.re, err = regexp.Compile("^" + rx.String() + "$")
+	default:
+		r.re, err = regexp.Compile("(^|/)" + rx.String() + "$")
+	}
+	return r, err
+}
+
+// bracketClass converts the bracket expression at the start of pattern to a
+// regexp character class, it returns the class and the length of the bracket
+// expression, or 0 if it is not terminated. Like in rsync a leading ']' is
+// part of the set, "!" or "^" negate it, [:name:] are POSIX classes and
+// nothing matches '/'.
+func bracketClass(pattern string) (string, int) {
+	var rx bytes.Buffer
+	rx.WriteString("[")
+	i := 1
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		rx.WriteString("^/")
+		i++
+	}
+	first := true
+	for ; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == ']' && !first:
+			rx.WriteString("]")
+			return rx.String(), i + 1
+		case c == '[' && i+1 < len(pattern) && pattern[i+1] == ':':
+			j := strings.Index(pattern[i+2:], ":]")
+			if j < 0 {
+				rx.WriteString("\\[")
+				break
+			}
+			rx.WriteString(pattern[i : i+2+j+2])
+			i += 2 + j + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			rx.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '-' && !first && i+1 < len(pattern) && pattern[i+1] != ']':
+			rx.WriteString("-")
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80:
+			rx.WriteByte(c)
+		default:
+			rx.WriteString("\\" + string(c))
+		}
+		first = false
+	}
+	return "", 0
+}
+
+func (r *filterRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if !r.full {
+		rel = filepath.Base(rel)
+	}
+	return r.re.MatchString(rel)
+}
+
+// patternLine is a pattern and where it comes from, for error messages
+type patternLine struct {
+	pattern string
+	source  string
+}
+
+func readPatternFile(path string) ([]patternLine, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can not read %s: %v", path, err)
+	}
+	defer fh.Close()
+	r := []patternLine{}
+	lineno := 0
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		r = append(r, patternLine{line, fmt.Sprintf("%s:%d", path, lineno)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can not read %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// loadFilterRules loads the include/exclude rules in the same order they are
+// passed to rsync
+func (r *Repository) loadFilterRules() error {
+	var exclude, include []patternLine
+	if r.cfg.ExcludeFrom != "" {
+		patterns, err := readPatternFile(r.cfg.ExcludeFrom)
+		if err != nil {
+			return err
+		}
+		exclude = append(exclude, patterns...)
+	}
+	if r.cfg.IncludeFrom != "" {
+		patterns, err := readPatternFile(r.cfg.IncludeFrom)
+		if err != nil {
+			return err
+		}
+		include = append(include, patterns...)
+	}
+
+	r.filters = []filterRule{}
+	add := func(include bool, patterns []patternLine) error {
+		for _, p := range patterns {
+			rule, err := compileFilterRule(include, p.pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern %q: %v", p.source, p.pattern, err)
+			}
+			r.filters = append(r.filters, rule)
+		}
+		return nil
+	}
+	options := func(kind string, patterns []string) []patternLine {
+		r := make([]patternLine, len(patterns))
+		for i := range patterns {
+			r[i] = patternLine{patterns[i], kind + " option"}
+		}
+		return r
+	}
+	if err := add(false, exclude); err != nil {
+		return err
+	}
+	if err := add(true, include); err != nil {
+		return err
+	}
+	if err := add(false, options("exclude", r.cfg.Exclude)); err != nil {
+		return err
+	}
+	return add(true, options("include", r.cfg.Include))
+}
+
+// excluded returns true if rsync would not copy rel (a path relative to the
+// source directory), like rsync the first matching rule wins
+func (r *Repository) excluded(rel string, isDir bool) bool {
+	for i := range r.filters {
+		if r.filters[i].match(rel, isDir) {
+			return !r.filters[i].include
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package beck
+
+import "testing"
+
+func TestCompileFilterRule(t *testing.T) {
+	tests := []struct {
+		pattern string
+		include bool
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{"*.o", false, "x.o", false, true},
+		{"*.o", false, "a/b/x.o", false, true},
+		{"*.o", false, "x.c", false, false},
+		{"a?c", false, "abc", false, true},
+		{"a?c", false, "ac", false, false},
+		{"*.[[:digit:]]", false, "f.1", false, true},
+		{"*.[[:digit:]]", false, "f.a", false, false},
+		{"[]x]", false, "]", false, true},
+		{"[]x]", false, "x", false, true},
+		{"[]x]", false, "y", false, false},
+		{"[!a]", false, "b", false, true},
+		{"[!a]", false, "a", false, false},
+		{"[^a]", false, "b", false, true},
+		{"[a-c]", false, "b", false, true},
+		{"[a-]", false, "-", false, true},
+		{"[a-]", false, "b", false, false},
+		{"[abc", false, "[abc", false, true},
+		{"[abc", false, "a", false, false},
+		{"\\*", false, "*", false, true},
+		{"\\*", false, "x", false, false},
+		{"/top", false, "top", false, true},
+		{"/top", false, "a/top", false, false},
+		{"a/b", false, "a/b", false, true},
+		{"a/b", false, "x/a/b", false, true},
+		{"a/b", false, "xa/b", false, false},
+		{"a/b", false, "a/b/c", false, false},
+		{"a/*/c", false, "a/b/c", false, true},
+		{"a/*/c", false, "a/b/b/c", false, false},
+		{"**/c", false, "a/b/b/c", false, true},
+		{"dir/", false, "dir", true, true},
+		{"dir/", false, "dir", false, false},
+		{"foo/***", false, "foo", true, true},
+		{"foo/***", false, "foo/bar/baz", false, true},
+		{"foo/***", false, "foobar", false, false},
+		{"+ keep", true, "keep", false, true},
+		{"- *.tmp", false, "x.tmp", false, true},
+	}
+	for _, tc := range tests {
+		rule, err := compileFilterRule(false, tc.pattern)
+		if err != nil {
+			t.Errorf("%q: %v", tc.pattern, err)
+			continue
+		}
+		if rule.include != tc.include {
+			t.Errorf("%q: include is %v", tc.pattern, rule.include)
+		}
+		if match := rule.match(tc.path, tc.isDir); match != tc.match {
+			t.Errorf("%q on %q: got %v, expected %v", tc.pattern, tc.path, match, tc.match)
+		}
+	}
+
+	for _, pattern := range []string{"[[:nosuchclass:]]", "[z-a]"} {
+		if _, err := compileFilterRule(false, pattern); err == nil {
+			t.Errorf("%q: no error", pattern)
+		}
+	}
+}
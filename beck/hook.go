@@ -0,0 +1,67 @@
+package beck
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Names of the hooks, executables in Config.HookDir that are run around
+// backups and prunes
+const (
+	HOOK_PRE_BACKUP          = "pre-backup"
+	HOOK_POST_BACKUP_SUCCESS = "post-backup-success"
+	HOOK_POST_BACKUP_FAILURE = "post-backup-failure"
+	HOOK_PRE_PRUNE           = "pre-prune"
+	HOOK_POST_PRUNE          = "post-prune"
+)
+
+// runHook runs the hook name, if it exists, with env added to its
+// environment. The hook also receives BECK_HOOK, BECK_PROFILE, BECK_SOURCE
+// and BECK_DEST, its output is written to the log.
+func (r *Repository) runHook(ctx context.Context, name string, env ...string) error {
+	if r.cfg.HookDir == "" {
+		return nil
+	}
+	path := filepath.Join(r.cfg.HookDir, name)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("hook %s: %v", name, err)
+	}
+
+	r.logf("Running hook %s", path)
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = r.cfg.HookDir
+	cmd.Env = append(os.Environ(),
+		"BECK_HOOK="+name,
+		"BECK_PROFILE="+r.cfg.Profile,
+		"BECK_SOURCE="+r.cfg.Source,
+		"BECK_DEST="+r.cfg.Destination)
+	cmd.Env = append(cmd.Env, env...)
+
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			r.logf("%s: %s", name, scanner.Text())
+		}
+		io.Copy(ioutil.Discard, pr)
+	}()
+	err := cmd.Run()
+	pw.Close()
+	<-done
+	if err != nil {
+		return fmt.Errorf("hook %s failed: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package beck
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockInfo describes who holds the lock on the backup directory, the lock
+// file contains "<pid> <host> <start time>"
+type lockInfo struct {
+	pid   int
+	host  string
+	start time.Time
+}
+
+func (l lockInfo) String() string {
+	return fmt.Sprintf("%d %s %d\n", l.pid, l.host, l.start.Unix())
+}
+
+// holder describes who holds the lock, for messages
+func (l lockInfo) holder() string {
+	if l.pid == 0 {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("process %d on %s", l.pid, l.host)
+}
+
+func parseLock(b []byte) (lockInfo, error) {
+	var l lockInfo
+	var start int64
+	if _, err := fmt.Sscanf(string(b), "%d %s %d", &l.pid, &l.host, &start); err != nil {
+		return l, fmt.Errorf("malformed lock file: %v", err)
+	}
+	l.start = time.Unix(start, 0)
+	return l, nil
+}
+
+// tryLock creates the lock file, if it already exists returns false and the
+// current content of the lock file. The lock is written to a temporary file
+// first and then linked in place, so that nobody can see it half written.
+func (r *Repository) tryLock(l lockInfo) (bool, lockInfo, []byte, error) {
+	tmp := fmt.Sprintf("%s.%d.%d.tmp", LOCK_NAME, l.pid, time.Now().UnixNano())
+	if err := r.writeBackupFile(tmp, os.O_CREATE|os.O_EXCL, []byte(l.String())); err != nil {
+		return false, l, nil, fmt.Errorf("could not create lock file: %v", err)
+	}
+	defer r.removeLockFile(tmp)
+
+	err := r.linkBackupFile(tmp, LOCK_NAME)
+	if err != nil {
+		// sftp servers do not reliably report why the file could not be
+		// created, if we can read it somebody else holds the lock
+		held, raw, rerr := r.readLock(LOCK_NAME)
+		if rerr != nil {
+			return false, held, nil, fmt.Errorf("could not create lock file: %v", err)
+		}
+		return false, held, raw, nil
+	}
+	return true, l, nil, nil
+}
+
+// linkBackupFile makes newName, in the backup directory, a new name for
+// oldName, it fails if newName already exists
+func (r *Repository) linkBackupFile(oldName, newName string) error {
+	if !r.remote {
+		return os.Link(r.dir(oldName), r.dir(newName))
+	}
+	sftpc, err := r.sftpClient()
+	if err != nil {
+		return err
+	}
+	// unlike posix-rename the rename of the sftp protocol does not replace
+	// newName
+	return sftpc.Rename(r.dir(oldName), r.dir(newName))
+}
+
+// readLock reads the lock file name, a lock file that can not be parsed is
+// reported as held by an unknown process since its modification time
+func (r *Repository) readLock(name string) (lockInfo, []byte, error) {
+	fh, err := r.openBackupFile(name)
+	if err != nil {
+		return lockInfo{}, nil, err
+	}
+	defer fh.Close()
+	b, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return lockInfo{}, nil, err
+	}
+	l, err := parseLock(b)
+	if err != nil {
+		l = lockInfo{start: time.Now()}
+		if fi, ok := fh.(interface{ Stat() (os.FileInfo, error) }); ok {
+			if info, err := fi.Stat(); err == nil {
+				l.start = info.ModTime()
+			}
+		}
+	}
+	return l, b, nil
+}
+
+// takeOverLock removes the stale lock file whose content is stale. The lock
+// file is renamed first and then checked, so that if somebody else took it
+// over in the meantime and created a new lock the new lock is put back
+// instead of being removed. If it can not be put back somebody else could
+// take the lock too, an error is returned so that we don't.
+func (r *Repository) takeOverLock(l lockInfo, stale []byte) error {
+	name := fmt.Sprintf("%s.%d.%d.stale", LOCK_NAME, l.pid, time.Now().UnixNano())
+	if err := r.renameBackupFile(LOCK_NAME, name); err != nil {
+		if r.lockGone() {
+			// somebody else removed it
+			return nil
+		}
+		return fmt.Errorf("could not remove stale lock: %v", err)
+	}
+	held, b, err := r.readLock(name)
+	if err == nil && !bytes.Equal(b, stale) {
+		r.logf("Lock file changed while removing it, putting it back")
+		if err := r.linkBackupFile(name, LOCK_NAME); err != nil {
+			return fmt.Errorf("could not put back the lock of %s, moved to %s: %v", held.holder(), r.displayPath(name), err)
+		}
+	}
+	r.removeLockFile(name)
+	return nil
+}
+
+// lockGone returns true if there is no lock file
+func (r *Repository) lockGone() bool {
+	fh, err := r.openBackupFile(LOCK_NAME)
+	if err == nil {
+		fh.Close()
+	}
+	return os.IsNotExist(err)
+}
+
+// releaseLock removes the lock file, unless it is no longer l
+func (r *Repository) releaseLock(l lockInfo) {
+	held, b, err := r.readLock(LOCK_NAME)
+	if err != nil {
+		r.logf("Could not release lock: %v", err)
+		return
+	}
+	if string(b) != l.String() {
+		r.logf("Lock file was taken over by %s, leaving it in place", held.holder())
+		return
+	}
+	r.removeLockFile(LOCK_NAME)
+}
+
+func (r *Repository) removeLockFile(name string) {
+	if err := r.removeBackupFile(name); err != nil && !os.IsNotExist(err) {
+		r.logf("Could not remove lock file: %v", err)
+	}
+}
+
+// processStartTime returns the time a local process was started
+func processStartTime(pid int) (time.Time, bool) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, false
+	}
+	// the second field is the name of the executable, in parenthesis, and
+	// can contain spaces
+	v := strings.Fields(string(b[bytes.LastIndexByte(b, ')')+1:]))
+	if len(v) < 20 {
+		return time.Time{}, false
+	}
+	ticks, err := strconv.ParseInt(v[19], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	b, err = ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			btime, err := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+			// USER_HZ is 100 on every architecture we care about
+			return time.Unix(btime, 0).Add(time.Duration(ticks) * time.Second / 100), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// lockStale returns true if the process that created the lock is gone
+func lockStale(l lockInfo) bool {
+	hostname, _ := os.Hostname()
+	if l.host != hostname {
+		// we can't check processes on other machines
+		return time.Since(l.start) > STALE_LOCK_AGE
+	}
+	if err := syscall.Kill(l.pid, 0); err == syscall.ESRCH {
+		return true
+	}
+	if start, ok := processStartTime(l.pid); ok && start.After(l.start.Add(time.Minute)) {
+		// the pid was reused by a process started after the lock was taken
+		return true
+	}
+	return false
+}
+
+// acquireLock locks the backup directory so that only one instance of beck
+// can modify it, if the lock is held by somebody else waits up to wait for
+// it to be released. Returns a function that releases the lock.
+func (r *Repository) acquireLock(ctx context.Context, wait time.Duration) (func(), error) {
+	hostname, _ := os.Hostname()
+	l := lockInfo{os.Getpid(), hostname, time.Now()}
+	deadline := time.Now().Add(wait)
+
+	for {
+		ok, held, raw, err := r.tryLock(l)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() { r.releaseLock(l) }, nil
+		}
+
+		if lockStale(held) {
+			r.logf("Removing stale lock of %s (started %s)", held.holder(), held.start.Format(time.RFC1123))
+			if err := r.takeOverLock(l, raw); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%s is locked by %s since %s, wait for it or delete %s if it is not running", r.cfg.Destination, held.holder(), held.start.Format(time.RFC1123), r.displayPath(LOCK_NAME))
+		}
+		r.logf("%s is locked by %s, waiting", r.cfg.Destination, held.holder())
+		select {
+		case <-time.After(LOCK_POLL_INTERVAL):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// lock acquires the lock for an operation that modifies the backup directory,
+// see acquireLock. Dry runs do not modify it so they do not take the lock,
+// they only warn if somebody else holds it.
+func (r *Repository) lock(ctx context.Context, dryRun bool, wait time.Duration) (func(), error) {
+	if !dryRun {
+		return r.acquireLock(ctx, wait)
+	}
+	if held, _, err := r.readLock(LOCK_NAME); err == nil && !lockStale(held) {
+		r.logf("%s is locked by %s, the result of the dry run could be out of date", r.cfg.Destination, held.holder())
+	}
+	return func() {}, nil
+}
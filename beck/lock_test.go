@@ -0,0 +1,43 @@
+package beck
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLockRelease(t *testing.T) {
+	dir := t.TempDir()
+	r, err := Open(Config{Source: dir, Destination: dir, Logger: log.New(ioutil.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := r.acquireLock(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.acquireLock(context.Background(), 0); err == nil {
+		t.Fatalf("lock acquired twice")
+	}
+	release()
+	if _, err := os.Stat(r.dir(LOCK_NAME)); !os.IsNotExist(err) {
+		t.Fatalf("lock not removed: %v", err)
+	}
+
+	// a lock taken over by somebody else is left alone
+	release, err = r.acquireLock(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := "1 otherhost 1700000000\n"
+	if err := ioutil.WriteFile(r.dir(LOCK_NAME), []byte(other), 0644); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if b, err := ioutil.ReadFile(r.dir(LOCK_NAME)); err != nil || string(b) != other {
+		t.Errorf("lock of somebody else removed: %q %v", b, err)
+	}
+}
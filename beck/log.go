@@ -0,0 +1,281 @@
+package beck
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FileVersion is a version of a file, as returned by Repository.Log
+type FileVersion struct {
+	// First and Last are the timestamps of the first and last of the
+	// consecutive backups containing this version
+	First, Last string
+	// Missing is set if the file is not in those backups
+	Missing bool
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+	// Target is the target of symbolic links
+	Target string
+}
+
+// logEntry is the file examined by Log in one backup
+type logEntry struct {
+	date string
+	// info is nil if the file is not in the backup
+	info   os.FileInfo
+	target string
+	// key identifies the content of the file: its inode, its hash or its
+	// chunks
+	key string
+}
+
+// Log returns the history of a file (relative to the source directory or an
+// absolute path inside it) across all backups, from oldest to newest. Each
+// version groups the consecutive backups where the file is the same hard
+// link, has the same hash (on remote backup directories and when hard links
+// were broken) or the same chunks.
+func (r *Repository) Log(ctx context.Context, path string) ([]FileVersion, error) {
+	rel, err := r.sourceRelative(path)
+	if err != nil {
+		return nil, err
+	}
+	if rel == "." {
+		return nil, fmt.Errorf("%s is not a file inside the source directory", path)
+	}
+	dates, err := r.Dates()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []logEntry
+	switch {
+	case r.chunked():
+		entries, err = r.logEntriesTree(dates, rel)
+	case r.remote:
+		entries, err = r.logEntriesRemote(ctx, dates, rel)
+	default:
+		entries, err = r.logEntriesLocal(dates, rel)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []FileVersion{}
+	found := false
+	var prev *logEntry
+	for i := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		e := &entries[i]
+		if e.info != nil {
+			found = true
+			if e.info.IsDir() {
+				return nil, fmt.Errorf("%s is a directory in %s%s", rel, BACKUP_PREFIX, e.date)
+			}
+		}
+		if prev != nil && r.sameLogEntry(prev, e, rel) {
+			versions[len(versions)-1].Last = e.date
+			prev = e
+			continue
+		}
+		v := FileVersion{First: e.date, Last: e.date, Missing: e.info == nil}
+		if e.info != nil {
+			v.Mode, v.Size, v.ModTime, v.Target = e.info.Mode(), e.info.Size(), e.info.ModTime(), e.target
+		}
+		versions = append(versions, v)
+		prev = e
+	}
+	if !found {
+		return nil, fmt.Errorf("%s not found in any backup of %s", rel, r.cfg.Destination)
+	}
+	return versions, nil
+}
+
+// sameLogEntry returns true if a and b, from consecutive backups, are the
+// same version of the file rel
+func (r *Repository) sameLogEntry(a, b *logEntry, rel string) bool {
+	if a.info == nil || b.info == nil {
+		return a.info == nil && b.info == nil
+	}
+	if a.info.Mode().Type() != b.info.Mode().Type() || a.target != b.target {
+		return false
+	}
+	if a.key == b.key {
+		return true
+	}
+	if r.chunked() || r.remote || !a.info.Mode().IsRegular() || a.info.Size() != b.info.Size() {
+		return false
+	}
+	// different inodes, the hard link was broken (for example by an import
+	// or by a copy of the backup directory) if the contents are the same
+	algo, _ := hashByName(DefaultHash)
+	buf := make([]byte, 64*1024)
+	ha, erra := checksum(algo, r.dir(BACKUP_PREFIX+a.date+"/"+rel), buf)
+	hb, errb := checksum(algo, r.dir(BACKUP_PREFIX+b.date+"/"+rel), buf)
+	return erra == nil && errb == nil && ha == hb
+}
+
+func (r *Repository) logEntriesLocal(dates []string, rel string) ([]logEntry, error) {
+	entries := make([]logEntry, len(dates))
+	for i, date := range dates {
+		entries[i].date = date
+		p := r.dir(BACKUP_PREFIX + date + "/" + rel)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) || isNotDir(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries[i].info = info
+		if (info.Mode() & os.ModeSymlink) != 0 {
+			entries[i].target, err = os.Readlink(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			entries[i].key = fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+		}
+	}
+	return entries, nil
+}
+
+// isNotDir returns true if err is caused by a component of the path that is
+// not a directory, which means that the file does not exist either
+func isNotDir(err error) bool {
+	if perr, ok := err.(*os.PathError); ok {
+		return perr.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+func (r *Repository) logEntriesRemote(ctx context.Context, dates []string, rel string) ([]logEntry, error) {
+	sftpc, err := r.sftpClient()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]logEntry, len(dates))
+	paths := []string{}
+	for i, date := range dates {
+		entries[i].date = date
+		p := BACKUP_PREFIX + date + "/" + rel
+		info, err := sftpc.Lstat(r.dir(p))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			// the sftp server does not tell ENOTDIR from other failures
+			if _, perr := sftpc.Stat(r.dir(BACKUP_PREFIX + date + "/" + filepath.Dir(rel))); perr == nil {
+				return nil, fmt.Errorf("can not stat %s: %v", r.displayPath(p), err)
+			}
+			continue
+		}
+		entries[i].info = info
+		switch {
+		case (info.Mode() & os.ModeSymlink) != 0:
+			entries[i].target, err = sftpc.ReadLink(r.dir(p))
+			if err != nil {
+				return nil, err
+			}
+		case info.Mode().IsRegular():
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return entries, nil
+	}
+	algo, _ := hashByName(DefaultHash)
+	hashes, err := r.remoteHashesOf(ctx, algo, r.path, paths)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].key = hashes[BACKUP_PREFIX+entries[i].date+"/"+rel]
+	}
+	return entries, nil
+}
+
+func (r *Repository) logEntriesTree(dates []string, rel string) ([]logEntry, error) {
+	entries := make([]logEntry, len(dates))
+	for i, date := range dates {
+		entries[i].date = date
+		t, err := r.readTree(date)
+		if err != nil {
+			return nil, err
+		}
+		e := t.find(rel)
+		if e == nil {
+			continue
+		}
+		entries[i].info = entryInfo{e}
+		entries[i].target = e.Target
+		entries[i].key = strings.Join(e.Objects, ",")
+	}
+	return entries, nil
+}
+
+// find returns the entry of t with path p, or nil
+func (t *tree) find(p string) *treeEntry {
+	i := sort.Search(len(t.Entries), func(i int) bool { return t.Entries[i].Path >= p })
+	if i < len(t.Entries) && t.Entries[i].Path == p {
+		return &t.Entries[i]
+	}
+	return nil
+}
+
+// ReadVersion returns the content of the file path (see Log) in the backup
+// described by spec (see Resolve)
+func (r *Repository) ReadVersion(ctx context.Context, spec, path string) ([]byte, error) {
+	rel, err := r.sourceRelative(path)
+	if err != nil {
+		return nil, err
+	}
+	date, err := r.Resolve(spec)
+	if err != nil {
+		return nil, err
+	}
+	if !r.chunked() {
+		name := BACKUP_PREFIX + date + "/" + rel
+		fh, err := r.openBackupFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("can not read %s: %v", r.displayPath(name), err)
+		}
+		defer fh.Close()
+		return ioutil.ReadAll(fh)
+	}
+
+	t, err := r.readTree(date)
+	if err != nil {
+		return nil, err
+	}
+	e := t.find(rel)
+	if e == nil || !e.Mode.IsRegular() {
+		return nil, fmt.Errorf("%s is not a file in %s%s", rel, BACKUP_PREFIX, date)
+	}
+	k, err := r.keys(false)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for _, id := range e.Objects {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		chunk, err := r.readObject(k, id)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, chunk...)
+	}
+	return buf, nil
+}
@@ -0,0 +1,311 @@
+package beck
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type manifestEntry struct {
+	hash  string
+	size  int64
+	mode  os.FileMode
+	mtime int64
+	path  string
+}
+
+// openBackupFile opens a file in the backup directory
+func (r *Repository) openBackupFile(name string) (io.ReadCloser, error) {
+	if !r.remote {
+		return os.Open(r.dir(name))
+	}
+	sftpc, err := r.sftpClient()
+	if err != nil {
+		return nil, err
+	}
+	return sftpc.Open(r.dir(name))
+}
+
+// createBackupFile opens a file in the backup directory for writing, flags
+// are passed to os.OpenFile (os.O_WRONLY is implied)
+func (r *Repository) createBackupFile(name string, flags int) (io.WriteCloser, error) {
+	flags |= os.O_WRONLY
+	if !r.remote {
+		return os.OpenFile(r.dir(name), flags, 0644)
+	}
+	sftpc, err := r.sftpClient()
+	if err != nil {
+		return nil, err
+	}
+	return sftpc.OpenFile(r.dir(name), flags)
+}
+
+// readManifest reads the manifest of backup.<date>, the first line of a
+// manifest is "# beck manifest <hash algorithm>", followed by a line for each
+// regular file in the snapshot:
+//
+//	<hash> <size> <mode> <mtime> <quoted path>
+func (r *Repository) readManifest(date string) (string, []manifestEntry, error) {
+	fh, err := r.openBackupFile(BACKUP_PREFIX + date + MANIFEST_SUFFIX)
+	if err != nil {
+		return "", nil, err
+	}
+	defer fh.Close()
+	gzrd, err := gzip.NewReader(fh)
+	if err != nil {
+		return "", nil, err
+	}
+	defer gzrd.Close()
+
+	scanner := bufio.NewScanner(gzrd)
+	if !scanner.Scan() {
+		return "", nil, fmt.Errorf("empty manifest")
+	}
+	var algo string
+	if _, err := fmt.Sscanf(scanner.Text(), "# beck manifest %s", &algo); err != nil {
+		return "", nil, fmt.Errorf("malformed manifest header: %v", err)
+	}
+
+	entries := []manifestEntry{}
+	for scanner.Scan() {
+		v := strings.SplitN(scanner.Text(), " ", 5)
+		if len(v) != 5 {
+			return "", nil, fmt.Errorf("malformed manifest line <%s>", scanner.Text())
+		}
+		var e manifestEntry
+		var mode uint64
+		var err [4]error
+		e.hash = v[0]
+		e.size, err[0] = strconv.ParseInt(v[1], 10, 64)
+		mode, err[1] = strconv.ParseUint(v[2], 8, 32)
+		e.mtime, err[2] = strconv.ParseInt(v[3], 10, 64)
+		e.path, err[3] = strconv.Unquote(v[4])
+		for i := range err {
+			if err[i] != nil {
+				return "", nil, fmt.Errorf("malformed manifest line <%s>: %v", scanner.Text(), err[i])
+			}
+		}
+		e.mode = os.FileMode(mode)
+		entries = append(entries, e)
+	}
+	return algo, entries, scanner.Err()
+}
+
+func (r *Repository) writeManifestFile(date, algo string, entries []manifestEntry) error {
+	name := BACKUP_PREFIX + date + MANIFEST_SUFFIX
+	fh, err := r.createBackupFile(name, os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("could not create manifest %s: %v", name, err)
+	}
+	gzw := gzip.NewWriter(fh)
+	w := bufio.NewWriter(gzw)
+	fmt.Fprintf(w, "# beck manifest %s\n", algo)
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s %d %o %d %s\n", e.hash, e.size, e.mode, e.mtime, strconv.Quote(e.path))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = gzw.Close()
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write manifest %s: %v", name, err)
+	}
+	return nil
+}
+
+// tryWriteManifest writes the manifest for a backup that is already in place,
+// a failure is only logged: the backup is complete even without a manifest,
+// it just can not be verified
+func (r *Repository) tryWriteManifest(ctx context.Context, date, prevDate string) {
+	if err := r.writeManifest(ctx, date, prevDate); err != nil {
+		r.logf("Could not write manifest of %s%s, the backup can not be verified: %v", BACKUP_PREFIX, date, err)
+	}
+}
+
+// writeManifest writes the manifest for backup.<date>. Files that are hard
+// links to files of backup.<prevDate> take their hash from its manifest.
+func (r *Repository) writeManifest(ctx context.Context, date, prevDate string) error {
+	algo, _ := hashByName(DefaultHash)
+
+	known := map[fileId]string{}
+	if prevDate != "" {
+		prevAlgo, prevEntries, err := r.readManifest(prevDate)
+		switch {
+		case err != nil:
+			r.logf("Could not read manifest of %s%s, all files will be hashed: %v", BACKUP_PREFIX, prevDate, err)
+		case prevAlgo != algo.name:
+			r.logf("Manifest of %s%s uses %s, all files will be hashed", BACKUP_PREFIX, prevDate, prevAlgo)
+		default:
+			prevHashes := map[string]string{}
+			for _, e := range prevEntries {
+				prevHashes[e.path] = e.hash
+			}
+			prevFiles, err := r.snapshotFiles(ctx, prevDate)
+			if err != nil {
+				return err
+			}
+			for _, f := range prevFiles {
+				if hash, ok := prevHashes[f.path]; ok {
+					known[f.id] = hash
+				}
+			}
+		}
+	}
+
+	files, err := r.snapshotFiles(ctx, date)
+	if err != nil {
+		return err
+	}
+	todo := []string{}
+	for _, f := range files {
+		if _, ok := known[f.id]; !ok {
+			todo = append(todo, f.path)
+		}
+	}
+	r.logf("Writing manifest of %s%s, hashing %d of %d files", BACKUP_PREFIX, date, len(todo), len(files))
+
+	var hashes map[string]string
+	if r.remote {
+		hashes, err = r.remoteHashesOf(ctx, algo, r.dir(BACKUP_PREFIX+date), todo)
+		if err != nil {
+			return fmt.Errorf("could not hash remote files: %v", err)
+		}
+	} else {
+		hashes = map[string]string{}
+		buf := make([]byte, 64*1024)
+		for _, path := range todo {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			hashes[path], err = checksum(algo, r.dir(BACKUP_PREFIX+date+"/"+path), buf)
+			if err != nil {
+				return fmt.Errorf("could not hash %s: %v", path, err)
+			}
+		}
+	}
+
+	entries := make([]manifestEntry, 0, len(files))
+	for _, f := range files {
+		hash, ok := known[f.id]
+		if !ok {
+			hash = hashes[f.path]
+		}
+		if hash == "" {
+			return fmt.Errorf("could not hash %s", f.path)
+		}
+		entries = append(entries, manifestEntry{hash, f.size, f.mode, f.mtime, f.path})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	return r.writeManifestFile(date, algo.name, entries)
+}
+
+// VerifyResult describes the verification of a backup against its manifest
+type VerifyResult struct {
+	Snapshot string
+	Files    int
+	// Problems are the differences between the backup and its manifest,
+	// their kind is one of MISSING, METADATA, FAILED and EXTRA
+	Problems []Problem
+}
+
+// OK returns true if the backup matches its manifest
+func (res *VerifyResult) OK() bool {
+	return len(res.Problems) == 0
+}
+
+// Verify checks a backup (see Resolve) against its manifest, every
+// difference is logged and returned in VerifyResult.Problems
+func (r *Repository) Verify(ctx context.Context, spec string) (*VerifyResult, error) {
+	date, err := r.Resolve(spec)
+	if err != nil {
+		return nil, err
+	}
+	if r.chunked() {
+		return r.verifyTree(ctx, date)
+	}
+	algoName, entries, err := r.readManifest(date)
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest of %s%s: %v", BACKUP_PREFIX, date, err)
+	}
+	algo, err := hashByName(algoName)
+	if err != nil {
+		return nil, err
+	}
+
+	r.logf("Verifying %s%s", BACKUP_PREFIX, date)
+
+	snapshotFiles, err := r.snapshotFiles(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]snapshotFile{}
+	for _, f := range snapshotFiles {
+		files[f.path] = f
+	}
+
+	var hashes map[string]string
+	if r.remote {
+		hashes, err = r.remoteHashes(ctx, algo, r.dir(BACKUP_PREFIX+date))
+		if err != nil {
+			return nil, fmt.Errorf("could not hash remote files: %v", err)
+		}
+	}
+
+	res := &VerifyResult{Snapshot: date, Files: len(entries)}
+	problem := func(kind, path string) {
+		if kind == "FAILED" {
+			r.logf("FAILED for %s", path)
+		} else {
+			r.logf("%s %s", kind, path)
+		}
+		res.Problems = append(res.Problems, Problem{kind, path})
+	}
+
+	buf := make([]byte, 64*1024)
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		f, found := files[e.path]
+		if !found {
+			problem("MISSING", e.path)
+			continue
+		}
+		delete(files, e.path)
+
+		if f.size != e.size || f.mode != e.mode || f.mtime != e.mtime {
+			problem("METADATA", e.path)
+		}
+
+		var hash string
+		if hashes != nil {
+			hash = hashes[e.path]
+		} else if hash, err = checksum(algo, r.dir(BACKUP_PREFIX+date+"/"+e.path), buf); err != nil {
+			r.logf("Error reading %s: %v", e.path, err)
+		}
+		if hash != e.hash {
+			problem("FAILED", e.path)
+		}
+	}
+
+	extra := []string{}
+	for path := range files {
+		extra = append(extra, path)
+	}
+	sort.Strings(extra)
+	for _, path := range extra {
+		problem("EXTRA", path)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,439 @@
+package beck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Engines that can be used to copy files, see Config.Engine
+const (
+	ENGINE_RSYNC  = "rsync"
+	ENGINE_NATIVE = "native"
+)
+
+// FileError is an error copying a single file
+type FileError struct {
+	Path string `json:"path"`
+	Err  string `json:"error"`
+}
+
+// copier is what nativeSync and chunkedBackup have in common: the summary of
+// the transfer, the files that could not be copied and the progress
+type copier struct {
+	r        *Repository
+	progress func(Progress)
+
+	t      Transfer
+	errors []FileError
+
+	start        time.Time
+	lastProgress time.Time
+	p            Progress
+}
+
+func newCopier(r *Repository, dryRun bool, progress func(Progress)) copier {
+	if dryRun {
+		progress = nil
+	}
+	return copier{r: r, progress: progress, start: time.Now()}
+}
+
+// fail records an error copying rel
+func (c *copier) fail(rel string, err error) {
+	c.r.logf("ERROR %s: %v", rel, err)
+	c.errors = append(c.errors, FileError{rel, err.Error()})
+}
+
+// itemize prints a line in the format of rsync's --itemize-changes
+func (c *copier) itemize(flags string, size int64, rel string) {
+	if c.progress == nil {
+		fmt.Fprintf(c.r.cfg.Stdout, "%s %d %s\n", flags, size, rel)
+	}
+}
+
+// deleted counts a file that is not in the source directory anymore
+func (c *copier) deleted(rel string) {
+	c.t.Deleted++
+	if c.progress == nil {
+		fmt.Fprintf(c.r.cfg.Stdout, "*deleting   %s\n", rel)
+	}
+}
+
+func (c *copier) updateProgress(rel string) {
+	if c.progress == nil || time.Since(c.lastProgress) < 200*time.Millisecond {
+		return
+	}
+	c.lastProgress = time.Now()
+	c.p.Bytes = c.t.TransferredSize
+	c.p.Files = c.t.Created + c.t.Updated
+	c.p.File = rel
+	if d := time.Since(c.start).Seconds(); d > 0 {
+		c.p.Rate = float64(c.p.Bytes) / d
+	}
+	c.progress(c.p)
+}
+
+// finish returns the summary of the transfer and the files that could not be
+// copied
+func (c *copier) finish(dryRun bool) (Transfer, []FileError, error) {
+	if c.t.TransferredSize > 0 {
+		c.t.Speedup = float64(c.t.TotalSize) / float64(c.t.TransferredSize)
+	}
+	if dryRun {
+		c.r.logDryRun(c.t)
+	}
+	if len(c.errors) > 0 {
+		return c.t, c.errors, fmt.Errorf("%d files could not be copied", len(c.errors))
+	}
+	return c.t, nil, nil
+}
+
+// setMetadata sets owner, permissions and modification time of p, only the
+// owner of symbolic links
+func setMetadata(p string, uid, gid int, mode os.FileMode, mtime time.Time) error {
+	// only root can do this
+	os.Lchown(p, uid, gid)
+	if (mode & os.ModeSymlink) != 0 {
+		return nil
+	}
+	if err := os.Chmod(p, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(p, mtime, mtime)
+}
+
+// setInfoMetadata copies owner, permissions and modification time from info
+// to p
+func setInfoMetadata(p string, info os.FileInfo) error {
+	st := info.Sys().(*syscall.Stat_t)
+	return setMetadata(p, int(st.Uid), int(st.Gid), info.Mode(), info.ModTime())
+}
+
+// warnRsyncOptions warns that Config.RsyncOptions are ignored when rsync is
+// not used to make backups
+func (r *Repository) warnRsyncOptions() {
+	ignored := []string{}
+	for _, opt := range r.cfg.RsyncOptions {
+		// implied by multiple roots, the snapshot has the same layout
+		// without rsync
+		if opt != "--relative" {
+			ignored = append(ignored, opt)
+		}
+	}
+	if len(ignored) > 0 {
+		r.logf("Ignoring rsync options %s, rsync is not used", strings.Join(ignored, " "))
+	}
+}
+
+// nativeSync copies the source directory to a snapshot without rsync,
+// following the semantics of rsync -a --delete --link-dest
+type nativeSync struct {
+	copier
+	ctx    context.Context
+	dryRun bool
+
+	// source is the source directory with symbolic links resolved, root is
+	// the root being copied
+	source, root string
+	// base is the previous snapshot, empty if there is none, dest is the
+	// snapshot being written
+	base, dest string
+	resuming   bool
+
+	// seen are the paths found in the source directory
+	seen map[string]bool
+	// dirs are the directories created, their metadata is set at the end
+	dirs []string
+	// dirInfos are the source directories corresponding to dirs
+	dirInfos []os.FileInfo
+}
+
+// syncNative copies the source directory to name, files that did not change
+// since backup.<base> are hard linked (if base is not empty)
+func (r *Repository) syncNative(ctx context.Context, dryRun bool, progress func(Progress), base, name string) (Transfer, []FileError, error) {
+	s := &nativeSync{copier: newCopier(r, dryRun, progress), ctx: ctx, dryRun: dryRun, dest: r.dir(name), seen: map[string]bool{}}
+	if base != "" {
+		s.base = r.dir(BACKUP_PREFIX + base)
+	}
+	if _, err := os.Lstat(s.dest); err == nil {
+		s.resuming = true
+	}
+	var err error
+	s.source, err = filepath.EvalSymlinks(r.cfg.Source)
+	if err != nil {
+		return s.t, nil, fmt.Errorf("can not read %s: %v", r.cfg.Source, err)
+	}
+
+	r.warnRsyncOptions()
+	if dryRun {
+		r.logf("Copying (dry run) %s to %s", r.cfg.Source, s.dest)
+	} else {
+		r.logf("Copying %s to %s", r.cfg.Source, s.dest)
+		if err := os.MkdirAll(s.dest, 0700); err != nil {
+			return s.t, nil, fmt.Errorf("could not create %s: %v", s.dest, err)
+		}
+	}
+
+	for _, root := range r.cfg.Roots {
+		s.root = filepath.Join(s.source, root)
+		s.impliedDirs(root)
+		if err := filepath.Walk(s.root, s.visit); err != nil {
+			if ctx.Err() != nil {
+				return s.t, s.errors, ctx.Err()
+			}
+			return s.t, s.errors, fmt.Errorf("can not read %s: %v", r.cfg.Source, err)
+		}
+	}
+	if s.resuming {
+		if err := filepath.Walk(s.dest, s.deleteExtra); err != nil {
+			return s.t, s.errors, err
+		}
+	}
+	if !dryRun {
+		for i := len(s.dirs) - 1; i >= 0; i-- {
+			if err := setInfoMetadata(s.dirs[i], s.dirInfos[i]); err != nil {
+				s.fail(s.dirs[i], err)
+			}
+		}
+	}
+	return s.finish(dryRun)
+}
+
+func (s *nativeSync) visit(path string, info os.FileInfo, err error) error {
+	if cerr := s.ctx.Err(); cerr != nil {
+		return cerr
+	}
+	rel, _ := filepath.Rel(s.source, path)
+	if err != nil {
+		if path == s.root && info == nil {
+			return err
+		}
+		s.fail(rel, err)
+		return nil
+	}
+	if rel != "." && s.r.excluded(rel, info.IsDir()) {
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	s.seen[rel] = true
+	s.t.Files++
+	dst := filepath.Join(s.dest, rel)
+	switch {
+	case info.IsDir():
+		s.dir(rel, dst, info)
+	case (info.Mode() & os.ModeSymlink) != 0:
+		s.symlink(rel, path, dst, info)
+	case info.Mode().IsRegular():
+		s.t.TotalSize += info.Size()
+		s.file(rel, path, dst, info)
+	default:
+		s.special(rel, dst, info)
+	}
+	return nil
+}
+
+// sameFile returns true if rsync would consider a and b the same file
+func sameFile(a, b os.FileInfo) bool {
+	return a.Mode().IsRegular() && b.Mode().IsRegular() && a.Size() == b.Size() && sameMetadata(a, b)
+}
+
+// replace removes dst, unless it is a directory and info is a directory
+func (s *nativeSync) replace(dst string, info os.FileInfo) error {
+	di, err := os.Lstat(dst)
+	if err != nil || (di.IsDir() && info.IsDir()) {
+		return nil
+	}
+	return os.RemoveAll(dst)
+}
+
+func (s *nativeSync) dir(rel, dst string, info os.FileInfo) {
+	if s.dryRun {
+		return
+	}
+	if err := s.replace(dst, info); err != nil {
+		s.fail(rel, err)
+		return
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		s.fail(rel, err)
+		return
+	}
+	s.dirs = append(s.dirs, dst)
+	s.dirInfos = append(s.dirInfos, info)
+}
+
+// impliedDirs copies the directories containing root, like rsync --relative
+// they get the owner, permissions and modification time of the source
+// directories
+func (s *nativeSync) impliedDirs(root string) {
+	parts := strings.Split(filepath.Clean(root), string(filepath.Separator))
+	for i := 1; i < len(parts); i++ {
+		rel := filepath.Join(parts[:i]...)
+		if s.seen[rel] {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(s.source, rel))
+		if err != nil {
+			s.fail(rel, err)
+			return
+		}
+		s.seen[rel] = true
+		s.dir(rel, filepath.Join(s.dest, rel), info)
+	}
+}
+
+func (s *nativeSync) symlink(rel, src, dst string, info os.FileInfo) {
+	target, err := os.Readlink(src)
+	if err != nil {
+		s.fail(rel, err)
+		return
+	}
+	if cur, err := os.Readlink(dst); err == nil && cur == target {
+		return
+	}
+	if s.dryRun {
+		return
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		s.fail(rel, err)
+		return
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		s.fail(rel, err)
+		return
+	}
+	setInfoMetadata(dst, info)
+}
+
+// special recreates sockets, FIFOs and device files, like rsync -a
+func (s *nativeSync) special(rel, dst string, info os.FileInfo) {
+	st := info.Sys().(*syscall.Stat_t)
+	if di, err := os.Lstat(dst); err == nil && di.Mode() == info.Mode() && di.Sys().(*syscall.Stat_t).Rdev == st.Rdev {
+		// copied before the backup was interrupted
+		return
+	}
+	if s.dryRun {
+		return
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		s.fail(rel, err)
+		return
+	}
+	// only root can create device files, the error is reported
+	if err := syscall.Mknod(dst, st.Mode, int(st.Rdev)); err != nil {
+		s.fail(rel, err)
+		return
+	}
+	if err := setInfoMetadata(dst, info); err != nil {
+		s.fail(rel, err)
+	}
+}
+
+func (s *nativeSync) file(rel, src, dst string, info os.FileInfo) {
+	if di, err := os.Lstat(dst); err == nil && sameFile(info, di) {
+		// copied before the backup was interrupted
+		return
+	}
+
+	flags := ">f+++++++++"
+	if s.base != "" {
+		basePath := filepath.Join(s.base, rel)
+		bi, err := os.Lstat(basePath)
+		if err == nil && sameFile(info, bi) {
+			if s.dryRun {
+				return
+			}
+			if err := s.replace(dst, info); err != nil {
+				s.fail(rel, err)
+				return
+			}
+			if err := os.Link(basePath, dst); err != nil {
+				s.fail(rel, err)
+			}
+			return
+		}
+		if err == nil {
+			flags = ">f.st......"
+		}
+	}
+
+	s.itemize(flags, info.Size(), rel)
+	if flags[2] == '+' {
+		s.t.Created++
+	} else {
+		s.t.Updated++
+	}
+	s.t.TransferredSize += info.Size()
+	if !s.dryRun {
+		if err := s.copyFile(src, dst, info); err != nil {
+			s.fail(rel, err)
+		}
+	}
+	s.updateProgress(rel)
+}
+
+func (s *nativeSync) copyFile(src, dst string, info os.FileInfo) error {
+	// dst could be a hard link to the previous snapshot, never write to it
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return setInfoMetadata(dst, info)
+}
+
+// deleteExtra removes the files of a resumed snapshot that are no longer in
+// the source directory
+func (s *nativeSync) deleteExtra(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	rel, _ := filepath.Rel(s.dest, path)
+	if rel == "." || s.seen[rel] {
+		return nil
+	}
+	if s.r.excluded(rel, info.IsDir()) {
+		// rsync does not delete excluded files either
+		return skipDir(info)
+	}
+	s.deleted(rel)
+	if !s.dryRun {
+		if err := os.RemoveAll(path); err != nil {
+			s.fail(rel, err)
+		}
+	}
+	return skipDir(info)
+}
+
+func skipDir(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package beck
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// OBJECTS_DIR is the directory, in a backup directory in the chunks format,
+// containing the chunks of the backed up files. Each chunk is stored once, in
+// objects/<xx>/<id> where id is the sha256 (HMAC in encrypted backup
+// directories) of its plaintext.
+const OBJECTS_DIR = "objects"
+
+// CHUNK_SIZE is the size of the chunks of version 1 trees, that cut files
+// at fixed offsets
+const CHUNK_SIZE = 1024 * 1024
+
+// TREE_VERSION is the version of the trees written by beck, version 2 trees
+// have content defined chunks (see chunker) and record their sizes
+const TREE_VERSION = 2
+
+// treeEntry describes a file in a snapshot of a backup directory in the
+// chunks format
+type treeEntry struct {
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	Uid     uint32      `json:"uid"`
+	Gid     uint32      `json:"gid"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	// Target is the target of symbolic links
+	Target string `json:"target,omitempty"`
+	// Objects are the chunks of regular files, in order
+	Objects []string `json:"objects,omitempty"`
+	// ChunkSizes are the sizes of Objects
+	ChunkSizes []int64 `json:"chunk_sizes,omitempty"`
+}
+
+// tree is the content of a backup.<timestamp> file in a backup directory in
+// the chunks format: all the files of the snapshot, sorted by path. It is
+// written as compressed JSON, then encrypted if the backup directory is
+// encrypted.
+type tree struct {
+	Version int         `json:"version"`
+	Entries []treeEntry `json:"entries"`
+}
+
+// entryInfo makes a treeEntry look like the lstat of a file
+type entryInfo struct {
+	e *treeEntry
+}
+
+func (fi entryInfo) Name() string       { return path.Base(fi.e.Path) }
+func (fi entryInfo) Size() int64        { return fi.e.Size }
+func (fi entryInfo) Mode() os.FileMode  { return fi.e.Mode }
+func (fi entryInfo) ModTime() time.Time { return fi.e.ModTime }
+func (fi entryInfo) IsDir() bool        { return fi.e.Mode.IsDir() }
+func (fi entryInfo) Sys() interface{}   { return fi.e }
+
+// contentId returns an identifier of the contents of a regular file, that
+// takes the place of the inode number of a file in a hard linked snapshot
+func (e *treeEntry) contentId() fileId {
+	sum := sha256.Sum256([]byte(strings.Join(e.Objects, "")))
+	return fileId{binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:16])}
+}
+
+// chunkSizes returns the sizes of the chunks of e
+func (e *treeEntry) chunkSizes() []int64 {
+	if len(e.ChunkSizes) == len(e.Objects) {
+		return e.ChunkSizes
+	}
+	// written by a version 1 tree, all chunks but the last are CHUNK_SIZE
+	sizes := make([]int64, len(e.Objects))
+	for i := range sizes {
+		sizes[i] = CHUNK_SIZE
+	}
+	if len(sizes) > 0 {
+		sizes[len(sizes)-1] = e.Size - int64(len(sizes)-1)*CHUNK_SIZE
+	}
+	return sizes
+}
+
+func objectName(id string) string {
+	return OBJECTS_DIR + "/" + id[:2] + "/" + id
+}
+
+// readDirNames returns the names of the entries of a directory in the backup
+// directory
+func (r *Repository) readDirNames(name string) ([]string, error) {
+	var infos []os.FileInfo
+	var err error
+	if r.remote {
+		sftpc, serr := r.sftpClient()
+		if serr != nil {
+			return nil, serr
+		}
+		infos, err = sftpc.ReadDir(r.dir(name))
+	} else {
+		infos, err = ioutil.ReadDir(r.dir(name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i := range infos {
+		names[i] = infos[i].Name()
+	}
+	return names, nil
+}
+
+// mkdirBackup creates a directory, and its parents, in the backup directory
+func (r *Repository) mkdirBackup(name string) error {
+	if !r.remote {
+		return os.MkdirAll(r.dir(name), 0755)
+	}
+	sftpc, err := r.sftpClient()
+	if err != nil {
+		return err
+	}
+	return sftpc.MkdirAll(r.dir(name))
+}
+
+// renameBackupFile renames a file of the backup directory, replacing newName
+// if it exists
+func (r *Repository) renameBackupFile(oldName, newName string) error {
+	if !r.remote {
+		return os.Rename(r.dir(oldName), r.dir(newName))
+	}
+	sftpc, err := r.sftpClient()
+	if err != nil {
+		return err
+	}
+	return sftpc.PosixRename(r.dir(oldName), r.dir(newName))
+}
+
+// removeBackupFile removes a file of the backup directory
+func (r *Repository) removeBackupFile(name string) error {
+	if !r.remote {
+		return os.Remove(r.dir(name))
+	}
+	sftpc, err := r.sftpClient()
+	if err != nil {
+		return err
+	}
+	return sftpc.Remove(r.dir(name))
+}
+
+// readBackupFile returns the content of a file in the backup directory
+func (r *Repository) readBackupFile(name string) ([]byte, error) {
+	fh, err := r.openBackupFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return ioutil.ReadAll(fh)
+}
+
+// objectSet returns the ids of all the objects in the backup directory
+func (r *Repository) objectSet() (map[string]bool, error) {
+	objects := map[string]bool{}
+	dirs, err := r.readDirNames(OBJECTS_DIR)
+	if os.IsNotExist(err) {
+		return objects, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can not read %s: %v", r.displayPath(OBJECTS_DIR), err)
+	}
+	for _, dir := range dirs {
+		names, err := r.readDirNames(OBJECTS_DIR + "/" + dir)
+		if err != nil {
+			return nil, fmt.Errorf("can not read %s: %v", r.displayPath(OBJECTS_DIR+"/"+dir), err)
+		}
+		for _, name := range names {
+			if !strings.HasSuffix(name, ".tmp") {
+				objects[name] = true
+			}
+		}
+	}
+	return objects, nil
+}
+
+// writeObject stores chunk, encrypted if the backup directory is encrypted,
+// as the object id. The object is written to a temporary file first so that
+// an interrupted backup does not leave a truncated object behind
+func (r *Repository) writeObject(k *cryptKeys, id string, chunk []byte) error {
+	buf, err := k.seal(id, chunk)
+	if err != nil {
+		return err
+	}
+	name := objectName(id)
+	if err := r.mkdirBackup(path.Dir(name)); err != nil {
+		return fmt.Errorf("could not create %s: %v", path.Dir(name), err)
+	}
+	if err := r.writeBackupFile(name+".tmp", os.O_CREATE|os.O_TRUNC, buf); err != nil {
+		return err
+	}
+	if err := r.renameBackupFile(name+".tmp", name); err != nil {
+		return fmt.Errorf("could not rename %s: %v", name+".tmp", err)
+	}
+	return nil
+}
+
+// readObject returns the (decrypted) content of the object id, checking that it
+// matches its id
+func (r *Repository) readObject(k *cryptKeys, id string) ([]byte, error) {
+	buf, err := r.readBackupFile(objectName(id))
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := k.open(id, buf)
+	if err != nil {
+		return nil, err
+	}
+	if k.id(chunk) != id {
+		return nil, fmt.Errorf("%s: content does not match its id", id)
+	}
+	return chunk, nil
+}
+
+// readTree reads the tree of the snapshot backup.<date>, the returned tree
+// is shared and must not be modified
+func (r *Repository) readTree(date string) (*tree, error) {
+	if t, ok := r.trees[date]; ok {
+		return t, nil
+	}
+	k, err := r.keys(false)
+	if err != nil {
+		return nil, err
+	}
+	name := BACKUP_PREFIX + date
+	buf, err := r.readBackupFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("can not read %s: %v", r.displayPath(name), err)
+	}
+	buf, err = k.open(name, buf)
+	if err != nil {
+		return nil, err
+	}
+	gzrd, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("malformed tree %s: %v", name, err)
+	}
+	var t tree
+	if err := json.NewDecoder(gzrd).Decode(&t); err != nil {
+		return nil, fmt.Errorf("malformed tree %s: %v", name, err)
+	}
+	if t.Version > TREE_VERSION {
+		return nil, fmt.Errorf("%s was written by a newer version of beck", name)
+	}
+	if r.trees == nil {
+		r.trees = map[string]*tree{}
+	}
+	r.trees[date] = &t
+	return &t, nil
+}
+
+// writeTree writes t to the file name, as the tree of backup.<date>
+func (r *Repository) writeTree(k *cryptKeys, name, date string, t *tree) error {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gzw).Encode(t); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+	sealed, err := k.seal(BACKUP_PREFIX+date, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return r.writeBackupFile(name, os.O_CREATE|os.O_TRUNC, sealed)
+}
+
+// snapshotFilesTree lists all regular files in the tree of backup.<date>
+func (r *Repository) snapshotFilesTree(date string) ([]snapshotFile, error) {
+	t, err := r.readTree(date)
+	if err != nil {
+		return nil, err
+	}
+	files := []snapshotFile{}
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		if !e.Mode.IsRegular() {
+			continue
+		}
+		files = append(files, snapshotFile{e.contentId(), 1, e.Size, e.Mode.Perm(), e.ModTime.Unix(), e.Path})
+	}
+	return files, nil
+}
@@ -0,0 +1,68 @@
+package beck
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is the state of a running backup, as reported by rsync's
+// --info=progress2
+type Progress struct {
+	// Bytes is the amount of data transferred so far
+	Bytes int64
+	// Percent is how much of the whole transfer is done, it is not known
+	// by the native engine
+	Percent int
+	// Rate is the current transfer rate, in bytes per second
+	Rate float64
+	// ETA is the estimated time remaining
+	ETA time.Duration
+	// Files is the number of files transferred so far
+	Files int
+	// File is the last file transferred
+	File string
+}
+
+// progressRe matches the lines printed by --info=progress2, ex:
+//
+//	1,234,567  45%   12.34MB/s    0:00:10 (xfr#5, to-chk=100/200)
+var progressRe = regexp.MustCompile(`^\s*([\d,]+)\s+(\d+)%\s+([\d.,]+)([kMGT]?B)/s\s+(\d+):(\d\d):(\d\d)(?:\s+\(xfr#(\d+),)?`)
+
+// rateUnits are the units of the transfer rate, rsync uses binary multiples
+var rateUnits = map[string]float64{"B": 1, "kB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40}
+
+// parseProgress updates p with a progress line of rsync, returns false if
+// line is not a progress line
+func parseProgress(line string, p *Progress) bool {
+	m := progressRe.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	p.Bytes, _ = strconv.ParseInt(strings.Replace(m[1], ",", "", -1), 10, 64)
+	p.Percent, _ = strconv.Atoi(m[2])
+	p.Rate, _ = strconv.ParseFloat(strings.Replace(m[3], ",", "", -1), 64)
+	p.Rate *= rateUnits[m[4]]
+	h, _ := strconv.Atoi(m[5])
+	min, _ := strconv.Atoi(m[6])
+	s, _ := strconv.Atoi(m[7])
+	p.ETA = time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + time.Duration(s)*time.Second
+	if m[8] != "" {
+		p.Files, _ = strconv.Atoi(m[8])
+	}
+	return true
+}
+
+// scanLines is like bufio.ScanLines but also splits at carriage returns,
+// which rsync uses to update its progress line
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,34 @@
+package beck
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProgress(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+		want Progress
+	}{
+		{"      1,234,567  45%   12.34MB/s    0:00:10 (xfr#5, to-chk=100/200)", true,
+			Progress{Bytes: 1234567, Percent: 45, Rate: 12.34 * (1 << 20), ETA: 10 * time.Second, Files: 5}},
+		{"         32,768 100%    1.00kB/s    1:02:03", true,
+			Progress{Bytes: 32768, Percent: 100, Rate: 1024, ETA: time.Hour + 2*time.Minute + 3*time.Second}},
+		{"    999   0%    0.00B/s    0:00:00  (xfr#0, ir-chk=1000/1001)", true,
+			Progress{Bytes: 999}},
+		{">f+++++++++ 100 file", false, Progress{}},
+		{"Number of files: 1,234", false, Progress{}},
+		{"", false, Progress{}},
+	}
+	for _, tc := range tests {
+		var p Progress
+		if ok := parseProgress(tc.line, &p); ok != tc.ok {
+			t.Errorf("%q: got %v, expected %v", tc.line, ok, tc.ok)
+			continue
+		}
+		if p != tc.want {
+			t.Errorf("%q: got %+v, expected %+v", tc.line, p, tc.want)
+		}
+	}
+}
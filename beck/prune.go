@@ -0,0 +1,316 @@
+package beck
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrunePolicy decides which backups are kept by Prune
+type PrunePolicy struct {
+	Last, Hourly, Daily, Weekly, Monthly, Yearly int
+	Within                                       time.Duration
+}
+
+func (p *PrunePolicy) Empty() bool {
+	return p.Last <= 0 && p.Hourly <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0 && p.Yearly <= 0 && p.Within <= 0
+}
+
+// Flags defines the -keep-* flags, which set the fields of p, in fs
+func (p *PrunePolicy) Flags(fs *flag.FlagSet) {
+	fs.IntVar(&p.Last, "keep-last", p.Last, "Keep the last N snapshots")
+	fs.IntVar(&p.Hourly, "keep-hourly", p.Hourly, "Keep the last snapshot of each of the last N hours")
+	fs.IntVar(&p.Daily, "keep-daily", p.Daily, "Keep the last snapshot of each of the last N days")
+	fs.IntVar(&p.Weekly, "keep-weekly", p.Weekly, "Keep the last snapshot of each of the last N weeks")
+	fs.IntVar(&p.Monthly, "keep-monthly", p.Monthly, "Keep the last snapshot of each of the last N months")
+	fs.IntVar(&p.Yearly, "keep-yearly", p.Yearly, "Keep the last snapshot of each of the last N years")
+	fs.Var((*retentionDuration)(&p.Within), "keep-within", "Keep all snapshots made within this amount of time (ex. 36h, 10d, 4w)")
+}
+
+type retentionDuration time.Duration
+
+func (d *retentionDuration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *retentionDuration) Set(s string) error {
+	v, err := parseRetentionDuration(s)
+	*d = retentionDuration(v)
+	return err
+}
+
+// parseRetentionDuration is like time.ParseDuration but also accepts days (d)
+// and weeks (w)
+func parseRetentionDuration(s string) (time.Duration, error) {
+	mult := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		mult = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		mult = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(n) * mult, nil
+}
+
+// pruneSelect decides which snapshots to keep, dates must be sorted from
+// oldest to newest. Returns a map from the kept dates to the reason they were
+// kept.
+func pruneSelect(dates []string, p PrunePolicy, now time.Time) map[string]string {
+	keep := map[string]string{}
+	if len(dates) == 0 {
+		return keep
+	}
+
+	// the most recent snapshot is the base of the next incremental backup
+	keep[dates[len(dates)-1]] = "newest"
+
+	for i := len(dates) - 1; i >= 0 && i >= len(dates)-p.Last; i-- {
+		keep[dates[i]] = "last"
+	}
+
+	buckets := []struct {
+		name string
+		n    int
+		key  func(t time.Time) string
+	}{
+		{"hourly", p.Hourly, func(t time.Time) string { return t.Format("2006010215") }},
+		{"daily", p.Daily, func(t time.Time) string { return t.Format("20060102") }},
+		{"weekly", p.Weekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%04d%02d", y, w)
+		}},
+		{"monthly", p.Monthly, func(t time.Time) string { return t.Format("200601") }},
+		{"yearly", p.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	for _, bucket := range buckets {
+		last := ""
+		cnt := 0
+		for i := len(dates) - 1; i >= 0 && cnt < bucket.n; i-- {
+			key := bucket.key(parseBackupDate(dates[i]))
+			if key == last {
+				continue
+			}
+			last = key
+			cnt++
+			if _, ok := keep[dates[i]]; !ok {
+				keep[dates[i]] = bucket.name
+			}
+		}
+	}
+
+	if p.Within > 0 {
+		for _, date := range dates {
+			if now.Sub(parseBackupDate(date)) <= p.Within {
+				if _, ok := keep[date]; !ok {
+					keep[date] = "within"
+				}
+			}
+		}
+	}
+
+	return keep
+}
+
+// freedSpace computes how much space is freed by deleting each of the
+// snapshots in dates, in order. Since snapshots are hard linked a file is
+// only freed when the last of its links is deleted.
+func (r *Repository) freedSpace(ctx context.Context, dates []string) (map[string]int64, error) {
+	if r.chunked() {
+		return r.freedChunks(dates)
+	}
+	remaining := map[fileId]uint64{}
+	freed := map[string]int64{}
+	for _, date := range dates {
+		freed[date] = 0
+		files, err := r.snapshotFiles(ctx, date)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			n, ok := remaining[f.id]
+			if !ok {
+				n = f.nlink
+			}
+			n--
+			remaining[f.id] = n
+			if n == 0 {
+				freed[date] += f.size
+			}
+		}
+	}
+	return freed, nil
+}
+
+func (r *Repository) deleteSnapshot(ctx context.Context, date string) error {
+	path := r.dir(BACKUP_PREFIX + date)
+	delete(r.trees, date)
+	if r.remote {
+		return r.cmdExecRemote(ctx, false, "rm", "-rf", shellQuote(path), shellQuote(path+MANIFEST_SUFFIX), shellQuote(path+REPORT_SUFFIX))
+	}
+	r.logf("Removing %s", path)
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("could not remove %s: %v", path, err)
+	}
+	for _, suffix := range []string{MANIFEST_SUFFIX, REPORT_SUFFIX} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove %s: %v", path+suffix, err)
+		}
+	}
+	return nil
+}
+
+// PruneOptions are the options of Repository.Prune
+type PruneOptions struct {
+	// Policy is the retention policy, if it is empty Config.Retention is used
+	Policy PrunePolicy
+	// DryRun only decides what would be removed
+	DryRun bool
+	// Wait is how long to wait for other instances of beck using the same
+	// backup directory
+	Wait time.Duration
+}
+
+// PruneResult describes what Prune (or Delete) removed
+type PruneResult struct {
+	// Dates are the timestamps of all backups, from oldest to newest
+	Dates []string
+	// Kept maps the timestamps of the kept backups to the reason they were
+	// kept, it is nil for Delete
+	Kept map[string]string
+	// Removed are the timestamps of the removed backups
+	Removed []string
+	// Freed is the space freed by removing each backup
+	Freed map[string]int64
+}
+
+// Prune removes the backups that are not kept by the retention policy, the
+// newest backup is always kept. The pre-prune hook runs before anything is
+// removed, if it fails nothing is removed, the post-prune hook runs
+// afterwards.
+func (r *Repository) Prune(ctx context.Context, opts PruneOptions) (*PruneResult, error) {
+	policy := opts.Policy
+	if policy.Empty() {
+		policy = r.cfg.Retention
+	}
+	if policy.Empty() {
+		return nil, fmt.Errorf("no retention policy")
+	}
+
+	release, err := r.lock(ctx, opts.DryRun, opts.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	res := &PruneResult{}
+	res.Dates, err = r.Dates()
+	if err != nil {
+		return nil, err
+	}
+	res.Kept = pruneSelect(res.Dates, policy, time.Now())
+
+	for _, date := range res.Dates {
+		if _, ok := res.Kept[date]; !ok {
+			res.Removed = append(res.Removed, date)
+		}
+	}
+
+	return res, r.removeSnapshots(ctx, res, opts.DryRun)
+}
+
+// DeleteOptions are the options of Repository.Delete
+type DeleteOptions struct {
+	// Snapshots are the backups to remove (see Resolve)
+	Snapshots []string
+	// DryRun only computes the space that would be freed
+	DryRun bool
+	// Wait is how long to wait for other instances of beck using the same
+	// backup directory
+	Wait time.Duration
+}
+
+// Delete removes the backups in DeleteOptions.Snapshots, running the same
+// hooks as Prune
+func (r *Repository) Delete(ctx context.Context, opts DeleteOptions) (*PruneResult, error) {
+	release, err := r.lock(ctx, opts.DryRun, opts.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	res := &PruneResult{}
+	res.Dates, err = r.Dates()
+	if err != nil {
+		return nil, err
+	}
+	removed := map[string]bool{}
+	for _, spec := range opts.Snapshots {
+		date, err := resolveSnapshot(res.Dates, spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", r.cfg.Destination, err)
+		}
+		removed[date] = true
+	}
+	for _, date := range res.Dates {
+		if removed[date] {
+			res.Removed = append(res.Removed, date)
+		}
+	}
+	return res, r.removeSnapshots(ctx, res, opts.DryRun)
+}
+
+// removeSnapshots removes res.Removed filling res.Freed, between the
+// pre-prune and post-prune hooks. In the chunks format the chunks that are
+// no longer used are removed too.
+func (r *Repository) removeSnapshots(ctx context.Context, res *PruneResult, dryRun bool) error {
+	var err error
+	res.Freed, err = r.freedSpace(ctx, res.Removed)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	removed := make([]string, len(res.Removed))
+	for i := range res.Removed {
+		removed[i] = BACKUP_PREFIX + res.Removed[i]
+	}
+	env := []string{"BECK_REMOVE=" + strings.Join(removed, " ")}
+	if err := r.runHook(ctx, HOOK_PRE_PRUNE, env...); err != nil {
+		return err
+	}
+	for _, date := range res.Removed {
+		if err = r.deleteSnapshot(ctx, date); err != nil {
+			break
+		}
+	}
+	if err == nil && r.chunked() {
+		err = r.collectGarbage(ctx)
+	}
+	if err == nil {
+		env = append(env, "BECK_STATUS=success")
+	} else {
+		env = append(env, "BECK_STATUS=failure", "BECK_ERROR="+err.Error())
+	}
+	if herr := r.runHook(context.Background(), HOOK_POST_PRUNE, env...); herr != nil {
+		if err != nil {
+			r.logf("%v", herr)
+		} else {
+			err = herr
+		}
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package beck
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPruneSelect(t *testing.T) {
+	dates := []string{
+		"20230615120000",
+		"20231231230000",
+		"20240101100000",
+		"20240101200000",
+		"20240102090000",
+		"20240103080000",
+		"20240103081500",
+	}
+	now := parseBackupDate("20240103120000")
+
+	tests := []struct {
+		name   string
+		dates  []string
+		policy PrunePolicy
+		keep   map[string]string
+	}{
+		{"empty", nil, PrunePolicy{Last: 3}, map[string]string{}},
+		{"newest", dates, PrunePolicy{}, map[string]string{
+			"20240103081500": "newest",
+		}},
+		{"last", dates, PrunePolicy{Last: 2}, map[string]string{
+			"20240103081500": "last",
+			"20240103080000": "last",
+		}},
+		{"hourly", dates, PrunePolicy{Hourly: 2}, map[string]string{
+			"20240103081500": "newest",
+			"20240102090000": "hourly",
+		}},
+		{"daily", dates, PrunePolicy{Daily: 3}, map[string]string{
+			"20240103081500": "newest",
+			"20240102090000": "daily",
+			"20240101200000": "daily",
+		}},
+		{"monthly", dates, PrunePolicy{Monthly: 3}, map[string]string{
+			"20240103081500": "newest",
+			"20231231230000": "monthly",
+			"20230615120000": "monthly",
+		}},
+		{"yearly", dates, PrunePolicy{Yearly: 5}, map[string]string{
+			"20240103081500": "newest",
+			"20231231230000": "yearly",
+		}},
+		{"within", dates, PrunePolicy{Within: 36 * time.Hour}, map[string]string{
+			"20240103081500": "newest",
+			"20240103080000": "within",
+			"20240102090000": "within",
+		}},
+		{"more than there is", dates, PrunePolicy{Last: 100}, map[string]string{
+			"20230615120000": "last",
+			"20231231230000": "last",
+			"20240101100000": "last",
+			"20240101200000": "last",
+			"20240102090000": "last",
+			"20240103080000": "last",
+			"20240103081500": "last",
+		}},
+	}
+	for _, tc := range tests {
+		keep := pruneSelect(tc.dates, tc.policy, now)
+		if !reflect.DeepEqual(keep, tc.keep) {
+			t.Errorf("%s: got %v, expected %v", tc.name, keep, tc.keep)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package beck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Transfer summarizes what rsync did, the counts of created, updated and
+// deleted files come from --itemize-changes, everything else from --stats
+type Transfer struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Deleted int `json:"deleted"`
+	// Files is the number of files in the source
+	Files int64 `json:"files"`
+	// TotalSize is the size of all files in the source
+	TotalSize int64 `json:"total_size"`
+	// TransferredSize is the size of the created and updated files
+	TransferredSize int64   `json:"transferred_size"`
+	BytesSent       int64   `json:"bytes_sent"`
+	BytesReceived   int64   `json:"bytes_received"`
+	Speedup         float64 `json:"speedup"`
+}
+
+// logDryRun logs what a dry run would have transferred
+func (r *Repository) logDryRun(t Transfer) {
+	r.logf("Dry run: %d files (%s) would be transferred, %d would be deleted", t.Created+t.Updated, HumanReadable(t.TransferredSize), t.Deleted)
+}
+
+// rsyncItemRe matches the lines printed for --out-format=%i %l %n%L
+var rsyncItemRe = regexp.MustCompile(`^([<>ch.][fdLDS][^ ]{9}) (\d+) `)
+
+// statNumber parses the number at the start of a --stats value, ex.
+// "1,234 (reg: 1,000, dir: 234)" or "5,678 bytes"
+func statNumber(s string) int64 {
+	s = strings.SplitN(s, " ", 2)[0]
+	n, _ := strconv.ParseInt(strings.Replace(s, ",", "", -1), 10, 64)
+	return n
+}
+
+// parseLine updates t with a line of output of rsync
+func (t *Transfer) parseLine(line string) {
+	if strings.HasPrefix(line, "*deleting") {
+		t.Deleted++
+		return
+	}
+	if m := rsyncItemRe.FindStringSubmatch(line); m != nil {
+		flags := m[1]
+		if (flags[0] != '<' && flags[0] != '>') || flags[1] != 'f' {
+			return
+		}
+		if strings.Trim(flags[2:], "+") == "" {
+			t.Created++
+		} else {
+			t.Updated++
+		}
+		n, _ := strconv.ParseInt(m[2], 10, 64)
+		t.TransferredSize += n
+		return
+	}
+	if i := strings.Index(line, "speedup is "); strings.HasPrefix(line, "total size is ") && i >= 0 {
+		f := strings.Fields(line[i+len("speedup is "):])
+		if len(f) > 0 {
+			t.Speedup, _ = strconv.ParseFloat(strings.Replace(f[0], ",", "", -1), 64)
+		}
+		return
+	}
+	v := strings.SplitN(line, ": ", 2)
+	if len(v) != 2 {
+		return
+	}
+	switch v[0] {
+	case "Number of files":
+		t.Files = statNumber(v[1])
+	case "Total file size":
+		t.TotalSize = statNumber(v[1])
+	case "Total transferred file size":
+		t.TransferredSize = statNumber(v[1])
+	case "Total bytes sent":
+		t.BytesSent = statNumber(v[1])
+	case "Total bytes received":
+		t.BytesReceived = statNumber(v[1])
+	}
+}
+
+// exitStatus returns the exit status of the command that returned err
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	return -1
+}
+
+// writeBackupFile writes buf to a file in the backup directory
+func (r *Repository) writeBackupFile(name string, flags int, buf []byte) error {
+	fh, err := r.createBackupFile(name, flags)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", name, err)
+	}
+	_, err = fh.Write(buf)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", name, err)
+	}
+	return nil
+}
+
+// writeReport writes res to backup.<date>.report.json, if complete is set,
+// and appends it as a single line to the history log
+func (r *Repository) writeReport(res *BackupResult, complete bool) error {
+	if r.cfg.Encrypted && len(res.Errors) > 0 {
+		// the report is not encrypted, it must not contain file names
+		rcopy := *res
+		rcopy.Errors = nil
+		res = &rcopy
+	}
+	if complete {
+		buf, err := json.MarshalIndent(res, "", "\t")
+		if err != nil {
+			return err
+		}
+		if err := r.writeBackupFile(BACKUP_PREFIX+res.Snapshot+REPORT_SUFFIX, os.O_CREATE|os.O_TRUNC, append(buf, '\n')); err != nil {
+			return err
+		}
+	}
+	buf, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return r.writeBackupFile(HISTORY_NAME, os.O_CREATE|os.O_APPEND, append(buf, '\n'))
+}
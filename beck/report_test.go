@@ -0,0 +1,46 @@
+package beck
+
+import "testing"
+
+func TestTransferParseLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  Transfer
+	}{
+		{"itemized", []string{
+			">f+++++++++ 100 new",
+			">f.st...... 50 dir/changed",
+			"<f+++++++++ 7 sent",
+			"cd+++++++++ 0 dir/",
+			"cL+++++++++ 0 link -> target",
+			".f...p..... 10 chmod-only",
+			"*deleting   gone",
+			"*deleting   dir/gone/",
+		}, Transfer{Created: 2, Updated: 1, Deleted: 2, TransferredSize: 157}},
+		{"stats", []string{
+			"Number of files: 1,234 (reg: 1,000, dir: 234)",
+			"Total file size: 5,678,901 bytes",
+			"Total transferred file size: 4,321 bytes",
+			"Total bytes sent: 10,000",
+			"Total bytes received: 123",
+			"Literal data: 4,321 bytes",
+			"total size is 5,678,901  speedup is 1,314.25",
+		}, Transfer{Files: 1234, TotalSize: 5678901, TransferredSize: 4321, BytesSent: 10000, BytesReceived: 123, Speedup: 1314.25}},
+		{"ignored", []string{
+			"",
+			"sending incremental file list",
+			"sent 10,000 bytes  received 123 bytes  20,246.00 bytes/sec",
+			"file with: colon",
+		}, Transfer{}},
+	}
+	for _, tc := range tests {
+		var tr Transfer
+		for _, line := range tc.lines {
+			tr.parseLine(line)
+		}
+		if tr != tc.want {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, tr, tc.want)
+		}
+	}
+}
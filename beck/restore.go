@@ -0,0 +1,96 @@
+package beck
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RestoreOptions are the options of Repository.Restore
+type RestoreOptions struct {
+	// Path is the file or directory to restore, either relative to the
+	// source directory or an absolute path inside it
+	Path string
+	// At is the backup to restore from (see Resolve), by default the latest
+	At string
+	// To is the directory where Path is restored, by default its original
+	// location
+	To string
+	// Force overwrites files that are newer than the backed up copy
+	Force bool
+	// DryRun only shows what would be restored
+	DryRun bool
+}
+
+// sourceRelative converts path to a path relative to the source directory,
+// paths outside of the source directory are rejected
+func (r *Repository) sourceRelative(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		rel := filepath.Clean(path)
+		if outsideDir(rel) {
+			return "", fmt.Errorf("%s is not inside the source directory %s", path, r.cfg.Source)
+		}
+		return rel, nil
+	}
+	src, err := filepath.EvalSymlinks(r.cfg.Source)
+	if err != nil {
+		return "", fmt.Errorf("can not access source directory %s: %v", r.cfg.Source, err)
+	}
+	rel, err := filepath.Rel(src, path)
+	if err != nil || outsideDir(rel) {
+		return "", fmt.Errorf("%s is not inside the source directory %s", path, src)
+	}
+	return rel, nil
+}
+
+// outsideDir returns true if the clean relative path rel climbs out of the
+// directory it is relative to
+func outsideDir(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Restore copies a file or directory from a backup back to the source
+// directory (or to RestoreOptions.To)
+func (r *Repository) Restore(ctx context.Context, opts RestoreOptions) error {
+	if r.chunked() {
+		return fmt.Errorf("%s is in the %s format, use extract", r.cfg.Destination, FORMAT_CHUNKS)
+	}
+	path, err := r.sourceRelative(opts.Path)
+	if err != nil {
+		return err
+	}
+
+	date, err := r.Resolve(opts.At)
+	if err != nil {
+		return err
+	}
+
+	dest := opts.To
+	if dest == "" {
+		dest = r.cfg.Source + "/" + filepath.Dir(path)
+	}
+	// rsync runs in the source directory, a relative path would be
+	// resolved against it instead of the current directory
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	if !opts.DryRun {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return fmt.Errorf("can not create %s: %v", dest, err)
+		}
+	}
+
+	rsyncArgs := []string{"rsync", "-v", "-a"}
+	if !opts.Force {
+		rsyncArgs = append(rsyncArgs, "--update")
+	}
+	rsyncArgs = append(rsyncArgs, r.rsyncRemoteShell()...)
+	rsyncArgs = append(rsyncArgs, r.rsyncPath(r.dir(BACKUP_PREFIX+date+"/"+path)), dest+"/")
+
+	r.logf("Restoring %s from %s%s to %s", path, BACKUP_PREFIX, date, dest)
+	_, err = r.rsync(ctx, opts.DryRun, nil, rsyncArgs)
+	return err
+}
@@ -0,0 +1,41 @@
+package beck
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceRelative(t *testing.T) {
+	src, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Repository{cfg: Config{Source: src}}
+	tests := []struct {
+		path string
+		rel  string
+		ok   bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/../b", "b", true},
+		{".", ".", true},
+		{"..foo", "..foo", true},
+		{src + "/a/b", "a/b", true},
+		{src, ".", true},
+		{"..", "", false},
+		{"../x", "", false},
+		{"a/../../x", "", false},
+		{src + "/../x", "", false},
+		{"/elsewhere", "", false},
+	}
+	for _, tc := range tests {
+		rel, err := r.sourceRelative(tc.path)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: unexpected error %v", tc.path, err)
+			continue
+		}
+		if rel != tc.rel {
+			t.Errorf("%q: got %q, expected %q", tc.path, rel, tc.rel)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package beck
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule decides when backups are made, either every Every or at the times
+// of day in At, optionally only on some days of the week
+type Schedule struct {
+	Every time.Duration
+	// At are the times of day, in minutes after midnight, sorted
+	At []int
+	// Weekdays are the days on which backups are made, all days if empty
+	Weekdays []time.Weekday
+
+	spec string
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseSchedule parses a schedule, either an interval (ex. "6h", "1d") or a
+// comma separated list of times of day optionally preceded by a comma
+// separated list of days of the week (ex. "03:00", "mon,thu 12:30,22:00")
+func ParseSchedule(spec string) (Schedule, error) {
+	s := Schedule{spec: spec}
+	if d, err := parseRetentionDuration(spec); err == nil {
+		if d <= 0 {
+			return s, fmt.Errorf("invalid schedule %q: interval must be positive", spec)
+		}
+		s.Every = d
+		return s, nil
+	}
+
+	v := strings.Fields(spec)
+	switch len(v) {
+	case 1:
+	case 2:
+		for _, day := range strings.Split(v[0], ",") {
+			wd, ok := weekdayNames[strings.ToLower(day)]
+			if !ok {
+				return s, fmt.Errorf("invalid schedule %q: unknown day %q", spec, day)
+			}
+			s.Weekdays = append(s.Weekdays, wd)
+		}
+		v = v[1:]
+	default:
+		return s, fmt.Errorf("invalid schedule %q", spec)
+	}
+
+	for _, at := range strings.Split(v[0], ",") {
+		hm := strings.SplitN(at, ":", 2)
+		if len(hm) != 2 {
+			return s, fmt.Errorf("invalid schedule %q: malformed time %q", spec, at)
+		}
+		h, err1 := strconv.Atoi(hm[0])
+		m, err2 := strconv.Atoi(hm[1])
+		if err1 != nil || err2 != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+			return s, fmt.Errorf("invalid schedule %q: malformed time %q", spec, at)
+		}
+		s.At = append(s.At, h*60+m)
+	}
+	sort.Ints(s.At)
+	return s, nil
+}
+
+func (s Schedule) String() string {
+	return s.spec
+}
+
+func (s Schedule) onDay(wd time.Weekday) bool {
+	if len(s.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range s.Weekdays {
+		if d == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns when the backup following one made at last is due, if last is
+// the zero time a backup is due immediately
+func (s Schedule) Next(last time.Time) time.Time {
+	if last.IsZero() || (s.Every <= 0 && len(s.At) == 0) {
+		return time.Time{}
+	}
+	if s.Every > 0 {
+		return last.Add(s.Every)
+	}
+	for i := 0; i <= 7; i++ {
+		d := last.AddDate(0, 0, i)
+		if !s.onDay(d.Weekday()) {
+			continue
+		}
+		for _, at := range s.At {
+			t := time.Date(d.Year(), d.Month(), d.Day(), at/60, at%60, 0, 0, d.Location())
+			if t.After(last) {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
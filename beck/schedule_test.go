@@ -0,0 +1,85 @@
+package beck
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		spec     string
+		every    time.Duration
+		at       []int
+		weekdays []time.Weekday
+		ok       bool
+	}{
+		{"6h", 6 * time.Hour, nil, nil, true},
+		{"1d", 24 * time.Hour, nil, nil, true},
+		{"2w", 14 * 24 * time.Hour, nil, nil, true},
+		{"03:00", 0, []int{180}, nil, true},
+		{"22:00,01:15", 0, []int{75, 1320}, nil, true},
+		{"mon,Thu 12:30,22:00", 0, []int{750, 1320}, []time.Weekday{time.Monday, time.Thursday}, true},
+		{"0h", 0, nil, nil, false},
+		{"-1h", 0, nil, nil, false},
+		{"10", 0, nil, nil, false},
+		{"24:00", 0, nil, nil, false},
+		{"12:60", 0, nil, nil, false},
+		{"someday 10:00", 0, nil, nil, false},
+		{"mon 10:00 extra", 0, nil, nil, false},
+	}
+	for _, tc := range tests {
+		s, err := ParseSchedule(tc.spec)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: unexpected error %v", tc.spec, err)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if s.Every != tc.every || !reflect.DeepEqual(s.At, tc.at) || !reflect.DeepEqual(s.Weekdays, tc.weekdays) {
+			t.Errorf("%q: got %v %v %v, expected %v %v %v", tc.spec, s.Every, s.At, s.Weekdays, tc.every, tc.at, tc.weekdays)
+		}
+		if s.String() != tc.spec {
+			t.Errorf("%q: String returned %q", tc.spec, s.String())
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	date := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	// a monday
+	last := date("2024-01-01 10:00")
+
+	tests := []struct {
+		spec string
+		last time.Time
+		next time.Time
+	}{
+		{"6h", last, date("2024-01-01 16:00")},
+		{"03:00", last, date("2024-01-02 03:00")},
+		{"12:30,22:00", last, date("2024-01-01 12:30")},
+		{"09:00,10:00", last, date("2024-01-02 09:00")},
+		{"thu 12:30", last, date("2024-01-04 12:30")},
+		{"sat,sun 08:00", last, date("2024-01-06 08:00")},
+		{"mon 09:00", last, date("2024-01-08 09:00")},
+		{"mon 10:00", last, date("2024-01-08 10:00")},
+		{"6h", time.Time{}, time.Time{}},
+		{"03:00", time.Time{}, time.Time{}},
+	}
+	for _, tc := range tests {
+		s, err := ParseSchedule(tc.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.spec, err)
+		}
+		if next := s.Next(tc.last); !next.Equal(tc.next) {
+			t.Errorf("%q after %v: got %v, expected %v", tc.spec, tc.last, next, tc.next)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package beck
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type fileId struct {
+	dev, ino uint64
+}
+
+type snapshotFile struct {
+	id    fileId
+	nlink uint64
+	size  int64
+	mode  os.FileMode
+	mtime int64
+	path  string
+}
+
+// snapshotFilesLocal lists all regular files in a local snapshot directory
+func snapshotFilesLocal(ctx context.Context, dir string) ([]snapshotFile, error) {
+	r := []snapshotFile{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if (info.Mode() & os.ModeType) != 0 {
+			return nil
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		r = append(r, snapshotFile{fileId{uint64(st.Dev), uint64(st.Ino)}, uint64(st.Nlink), info.Size(), info.Mode().Perm(), info.ModTime().Unix(), path[len(dir)+1:]})
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("can not read %s: %v", dir, err)
+	}
+	return r, nil
+}
+
+// snapshotFilesRemote lists all regular files in a remote snapshot directory,
+// sftp does not give us inode numbers so find is run on the remote host
+func (r *Repository) snapshotFilesRemote(ctx context.Context, dir string) ([]snapshotFile, error) {
+	out, err := r.cmdOutputRemote(ctx, nil, "find", shellQuote(dir), "-type", "f", "-printf", shellQuote("%D %i %n %s %m %T@ %P\\0"))
+	if err != nil {
+		return nil, fmt.Errorf("can not read %s: %v", dir, err)
+	}
+	files := []snapshotFile{}
+	for _, line := range strings.Split(string(out), "\x00") {
+		if line == "" {
+			continue
+		}
+		v := strings.SplitN(line, " ", 7)
+		if len(v) != 7 {
+			return nil, fmt.Errorf("could not parse find output: <%s>", line)
+		}
+		var f snapshotFile
+		var err [6]error
+		var mode uint64
+		f.id.dev, err[0] = strconv.ParseUint(v[0], 10, 64)
+		f.id.ino, err[1] = strconv.ParseUint(v[1], 10, 64)
+		f.nlink, err[2] = strconv.ParseUint(v[2], 10, 64)
+		f.size, err[3] = strconv.ParseInt(v[3], 10, 64)
+		mode, err[4] = strconv.ParseUint(v[4], 8, 32)
+		f.mtime, err[5] = strconv.ParseInt(strings.SplitN(v[5], ".", 2)[0], 10, 64)
+		for i := range err {
+			if err[i] != nil {
+				return nil, fmt.Errorf("could not parse find output: <%s>: %v", line, err[i])
+			}
+		}
+		f.mode = os.FileMode(mode)
+		f.path = v[6]
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// snapshotFiles lists all regular files in the snapshot backup.<date>
+func (r *Repository) snapshotFiles(ctx context.Context, date string) ([]snapshotFile, error) {
+	if r.chunked() {
+		return r.snapshotFilesTree(date)
+	}
+	if r.remote {
+		return r.snapshotFilesRemote(ctx, r.dir(BACKUP_PREFIX+date))
+	}
+	return snapshotFilesLocal(ctx, r.dir(BACKUP_PREFIX+date))
+}
+
+// resolveSnapshot returns the date of the snapshot described by spec, which
+// can be "latest", "N-ago" (N snapshots before the latest one), a full
+// timestamp or a prefix of one (the latest snapshot matching is returned)
+func resolveSnapshot(dates []string, spec string) (string, error) {
+	if len(dates) == 0 {
+		return "", fmt.Errorf("no backups found")
+	}
+	spec = strings.TrimPrefix(spec, BACKUP_PREFIX)
+
+	if spec == "" || spec == "latest" {
+		return dates[len(dates)-1], nil
+	}
+
+	if strings.HasSuffix(spec, "-ago") {
+		n, err := strconv.Atoi(spec[:len(spec)-len("-ago")])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("malformed snapshot specification %q", spec)
+		}
+		if n >= len(dates) {
+			return "", fmt.Errorf("only %d backups exist, can not go back %d", len(dates), n)
+		}
+		return dates[len(dates)-1-n], nil
+	}
+
+	for i := len(dates) - 1; i >= 0; i-- {
+		if strings.HasPrefix(dates[i], spec) {
+			return dates[i], nil
+		}
+	}
+	return "", fmt.Errorf("no backup matches %q", spec)
+}
+
+// Resolve returns the timestamp of the backup described by spec, which can
+// be "latest" (or empty), "N-ago" (N backups before the latest one), a full
+// timestamp or a prefix of one (the latest backup matching is returned)
+func (r *Repository) Resolve(spec string) (string, error) {
+	dates, err := r.Dates()
+	if err != nil {
+		return "", err
+	}
+	date, err := resolveSnapshot(dates, spec)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", r.cfg.Destination, err)
+	}
+	return date, nil
+}
+
+// Snapshot describes an entry of the backup directory
+type Snapshot struct {
+	Name string
+	// Date is the timestamp of the snapshot
+	Date string
+	Time time.Time
+	// Files is the number of regular files, Size their total size and
+	// UniqueSize the size of those that are not hard linked in other
+	// snapshots (in the chunks format, of the chunks no other snapshot uses)
+	Files      int
+	Size       int64
+	UniqueSize int64
+	// Incomplete is set for interrupted backups and imports and for empty
+	// backups
+	Incomplete bool
+	// Unparseable is set if the name of the entry is not a valid timestamp
+	Unparseable bool
+}
+
+// List returns all entries of the backup directory that look like a
+// snapshot, sorted by name
+func (r *Repository) List(ctx context.Context) ([]Snapshot, error) {
+	snapshots := []Snapshot{}
+	files := map[string][]snapshotFile{}
+	count := map[fileId]int{}
+	chunks := map[string]map[string]int64{}
+	chunkCount := map[string]int{}
+
+	names, err := r.readBackupDir()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !strings.HasPrefix(name, BACKUP_PREFIX) || strings.HasSuffix(name, MANIFEST_SUFFIX) || strings.HasSuffix(name, REPORT_SUFFIX) {
+			continue
+		}
+		s := Snapshot{Name: name}
+		partial := partialRe.FindStringSubmatch(name)
+		if partial == nil {
+			partial = importRe.FindStringSubmatch(name)
+		}
+		date, ok := backupDateOf(name)
+		if partial != nil {
+			date, ok = partial[1], true
+		}
+		var t time.Time
+		if ok {
+			t, err = time.ParseInLocation(BACKUP_DATE_FORMAT, date, time.Local)
+		}
+		if !ok || err != nil {
+			s.Unparseable = true
+			snapshots = append(snapshots, s)
+			continue
+		}
+		s.Date, s.Time = date, t
+		if partial != nil {
+			s.Incomplete = true
+			snapshots = append(snapshots, s)
+			continue
+		}
+
+		files[name], err = r.snapshotFiles(ctx, date)
+		if err != nil {
+			return nil, err
+		}
+		seen := map[fileId]bool{}
+		for _, f := range files[name] {
+			s.Files++
+			s.Size += f.size
+			if !seen[f.id] {
+				seen[f.id] = true
+				count[f.id]++
+			}
+		}
+		if r.chunked() {
+			chunks[name], err = r.snapshotChunks(date)
+			if err != nil {
+				return nil, err
+			}
+			for id := range chunks[name] {
+				chunkCount[id]++
+			}
+		}
+		s.Incomplete = s.Files == 0
+		snapshots = append(snapshots, s)
+	}
+
+	for i := range snapshots {
+		if r.chunked() {
+			for id, sz := range chunks[snapshots[i].Name] {
+				if chunkCount[id] == 1 {
+					snapshots[i].UniqueSize += sz
+				}
+			}
+			continue
+		}
+		seen := map[fileId]bool{}
+		for _, f := range files[snapshots[i].Name] {
+			if count[f.id] == 1 && !seen[f.id] {
+				seen[f.id] = true
+				snapshots[i].UniqueSize += f.size
+			}
+		}
+	}
+
+	return snapshots, nil
+}
+
+// SizeReport is the size of the files first introduced by each backup
+type SizeReport struct {
+	// Size maps the timestamp of each backup to the size of the files it
+	// introduced
+	Size map[string]int64
+	// Changes are the files introduced by each backup
+	Changes map[string][]FileSize
+}
+
+type FileSize struct {
+	Path string
+	Size int64
+}
+
+func newSizeReport() *SizeReport {
+	return &SizeReport{Size: map[string]int64{}, Changes: map[string][]FileSize{}}
+}
+
+func (rep *SizeReport) add(date string, sz int64, path string) {
+	rep.Size[date] += sz
+	rep.Changes[date] = append(rep.Changes[date], FileSize{path, sz})
+}
+
+// Print writes the report to w, if verbose is set the files introduced by
+// each backup (except the first one) are listed too
+func (rep *SizeReport) Print(w io.Writer, verbose bool) {
+	ks := make([]string, 0, len(rep.Size))
+	for k := range rep.Size {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+
+	first := true
+	for _, k := range ks {
+		fmt.Fprintf(w, "%s\t%s\n", k, HumanReadable(rep.Size[k]))
+		if verbose && !first {
+			for _, c := range rep.Changes[k] {
+				fmt.Fprintf(w, "\t%s %s\n", HumanReadable(c.Size), c.Path)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+		first = false
+	}
+}
+
+// ReadSizeReport reads the output of becksz.sh
+func ReadSizeReport(rd io.Reader) (*SizeReport, error) {
+	curInode := ""
+	dateList := []string{}
+	rep := newSizeReport()
+	curSz := int64(0)
+	curPath := ""
+
+	flushfn := func() {
+		if len(dateList) <= 0 {
+			return
+		}
+
+		sort.Strings(dateList)
+		rep.add(dateList[0], curSz, curPath)
+		if SZDEBUG {
+			fmt.Printf("Assigning %s to %s: %s\n", curInode, dateList[0], curPath)
+		}
+		dateList = dateList[0:0]
+	}
+
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 3)
+		switch len(line) {
+		case 0:
+			continue
+		case 3:
+			//nothing
+		default:
+			return nil, fmt.Errorf("could not parse input line: <%s>", scanner.Text())
+		}
+
+		inode := line[0]
+		sz, err := strconv.ParseInt(line[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse input line (malformed size): <%s>: %v", scanner.Text(), err)
+		}
+		path := strings.Split(line[2], "/")
+		date := ""
+		pathRest := ""
+
+		for i := range path {
+			if !strings.HasPrefix(path[i], BACKUP_PREFIX) {
+				continue
+			}
+
+			date = path[i][len(BACKUP_PREFIX):]
+			pathRest = strings.Join(path[i+1:], "/")
+			break
+		}
+
+		if date == "" {
+			return nil, fmt.Errorf("could not parse input line (no backup date): <%s>", scanner.Text())
+		}
+
+		if curInode != inode {
+			flushfn()
+			curInode = inode
+			curPath = pathRest
+			curSz = sz
+		}
+		dateList = append(dateList, date)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flushfn()
+
+	return rep, nil
+}
+
+// Sizes walks all backups and assigns each file to the oldest backup that
+// contains it, in the chunks format each chunk is assigned instead
+func (r *Repository) Sizes(ctx context.Context) (*SizeReport, error) {
+	dates, err := r.Dates()
+	if err != nil {
+		return nil, err
+	}
+	if r.chunked() {
+		return r.sizesChunked(dates)
+	}
+
+	rep := newSizeReport()
+	seen := map[fileId]bool{}
+	for _, date := range dates {
+		files, err := r.snapshotFiles(ctx, date)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if seen[f.id] {
+				continue
+			}
+			seen[f.id] = true
+			rep.add(date, f.size, f.path)
+			if SZDEBUG {
+				fmt.Printf("Assigning %d to %s: %s\n", f.id.ino, date, f.path)
+			}
+		}
+	}
+
+	return rep, nil
+}
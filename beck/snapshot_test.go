@@ -0,0 +1,37 @@
+package beck
+
+import "testing"
+
+func TestResolveSnapshot(t *testing.T) {
+	dates := []string{"20240101000000", "20240102000000", "20240201000000"}
+	tests := []struct {
+		dates []string
+		spec  string
+		date  string
+		ok    bool
+	}{
+		{dates, "", "20240201000000", true},
+		{dates, "latest", "20240201000000", true},
+		{dates, "0-ago", "20240201000000", true},
+		{dates, "2-ago", "20240101000000", true},
+		{dates, "3-ago", "", false},
+		{dates, "-1-ago", "", false},
+		{dates, "x-ago", "", false},
+		{dates, "20240102000000", "20240102000000", true},
+		{dates, "backup.20240102000000", "20240102000000", true},
+		{dates, "202401", "20240102000000", true},
+		{dates, "2024", "20240201000000", true},
+		{dates, "2023", "", false},
+		{nil, "latest", "", false},
+	}
+	for _, tc := range tests {
+		date, err := resolveSnapshot(tc.dates, tc.spec)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: unexpected error %v", tc.spec, err)
+			continue
+		}
+		if date != tc.date {
+			t.Errorf("%q: got %q, expected %q", tc.spec, date, tc.date)
+		}
+	}
+}
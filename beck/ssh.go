@@ -0,0 +1,291 @@
+package beck
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sshHostConfig is the part of ~/.ssh/config that applies to a host
+type sshHostConfig struct {
+	hostName       string
+	port           string
+	user           string
+	identityFiles  []string
+	knownHostsFile string
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return os.Getenv("HOME") + path[1:]
+	}
+	return path
+}
+
+func sshHostMatches(patterns []string, host string) bool {
+	r := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host)); ok {
+			if negated {
+				return false
+			}
+			r = true
+		}
+	}
+	return r
+}
+
+// readSshConfig reads the options for host from ~/.ssh/config, only Host
+// blocks are supported, Match blocks are ignored
+func readSshConfig(host string) sshHostConfig {
+	var cfg sshHostConfig
+	fh, err := os.Open(os.ExpandEnv("$HOME/.ssh/config"))
+	if err != nil {
+		return cfg
+	}
+	defer fh.Close()
+
+	matching := true
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		v := strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == '=' })
+		if len(v) < 2 {
+			continue
+		}
+		key, args := strings.ToLower(v[0]), v[1:]
+		value := strings.Trim(args[0], "\"")
+
+		switch key {
+		case "host":
+			matching = sshHostMatches(args, host)
+			continue
+		case "match":
+			matching = false
+			continue
+		}
+		if !matching {
+			continue
+		}
+
+		// like ssh the first value obtained for an option is used
+		switch key {
+		case "hostname":
+			if cfg.hostName == "" {
+				cfg.hostName = strings.Replace(value, "%h", host, -1)
+			}
+		case "port":
+			if cfg.port == "" {
+				cfg.port = value
+			}
+		case "user":
+			if cfg.user == "" {
+				cfg.user = value
+			}
+		case "identityfile":
+			cfg.identityFiles = append(cfg.identityFiles, expandHome(value))
+		case "userknownhostsfile":
+			if cfg.knownHostsFile == "" {
+				cfg.knownHostsFile = expandHome(value)
+			}
+		}
+	}
+	return cfg
+}
+
+// sshSigners returns the keys that can be used to authenticate: those held
+// by ssh-agent and those in identityFiles (or the default key files if
+// identityFiles is empty)
+func (r *Repository) sshSigners(identityFiles []string) []ssh.Signer {
+	signers := []ssh.Signer{}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if r.agentConn == nil {
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				r.logf("Could not connect to ssh-agent: %v", err)
+			}
+			r.agentConn = conn
+		}
+		if r.agentConn != nil {
+			agentSigners, err := agent.NewClient(r.agentConn).Signers()
+			if err != nil {
+				r.logf("Could not get keys from ssh-agent: %v", err)
+			}
+			signers = append(signers, agentSigners...)
+		}
+	}
+
+	explicit := len(identityFiles) > 0
+	if !explicit {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa", "id_dsa"} {
+			identityFiles = append(identityFiles, os.ExpandEnv("$HOME/.ssh/"+name))
+		}
+	}
+
+	for _, keyPath := range identityFiles {
+		b, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			if explicit || !os.IsNotExist(err) {
+				r.logf("Could not read %s: %v", keyPath, err)
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if _, encrypted := err.(*ssh.PassphraseMissingError); encrypted {
+			if len(signers) > 0 || r.cfg.Passphrase == nil {
+				// don't ask for a passphrase if the agent already gave us
+				// some keys, or if there is nobody to ask
+				continue
+			}
+			passphrase, perr := r.cfg.Passphrase(keyPath)
+			if perr != nil {
+				r.logf("Could not read passphrase: %v", perr)
+				continue
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte(passphrase))
+		}
+		if err != nil {
+			r.logf("Could not parse %s: %v", keyPath, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	return signers
+}
+
+// hostKeyCallback verifies host keys against knownHostsFile, unknown hosts
+// are added to it if Config.HostKeyPrompt accepts them
+func (r *Repository) hostKeyCallback(knownHostsFile string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		check, err := knownhosts.New(knownHostsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			err = check(hostname, remote, key)
+			keyErr, ok := err.(*knownhosts.KeyError)
+			if !ok {
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				return fmt.Errorf("host key for %s does not match %s:%d, somebody could be intercepting the connection", hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line)
+			}
+		}
+
+		// unknown host, trust on first use
+		fingerprint := ssh.FingerprintSHA256(key)
+		if r.cfg.HostKeyPrompt == nil {
+			return fmt.Errorf("unknown host %s (%s %s), add it to %s", hostname, key.Type(), fingerprint, knownHostsFile)
+		}
+		if !r.cfg.HostKeyPrompt(hostname, key.Type(), fingerprint) {
+			return fmt.Errorf("host key for %s rejected", hostname)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(knownHostsFile), 0700); err != nil {
+			return err
+		}
+		fh, err := os.OpenFile(knownHostsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		_, err = fmt.Fprintln(fh, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}
+}
+
+// noKey is a public key that never matches a known host
+type noKey struct{}
+
+func (noKey) Type() string                        { return "beck-no-key" }
+func (noKey) Marshal() []byte                     { return []byte("beck-no-key") }
+func (noKey) Verify([]byte, *ssh.Signature) error { return fmt.Errorf("not a key") }
+
+// knownHostKeyAlgorithms returns the host key algorithms the server must use
+// to be checked against the keys recorded for it in knownHostsFile, or nil
+// if the host is not known
+func knownHostKeyAlgorithms(knownHostsFile, hostport string) []string {
+	check, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil
+	}
+	remote, err := net.ResolveTCPAddr("tcp", hostport)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	// the error lists the keys known for the host
+	keyErr, ok := check(hostport, remote, noKey{}).(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+	algos := []string{}
+	seen := map[string]bool{}
+	for _, k := range keyErr.Want {
+		typ := k.Key.Type()
+		if seen[typ] {
+			continue
+		}
+		seen[typ] = true
+		if typ == ssh.KeyAlgoRSA {
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algos = append(algos, typ)
+	}
+	if len(algos) == 0 {
+		return nil
+	}
+	return algos
+}
+
+func (r *Repository) dial() (*ssh.Client, error) {
+	cfg := readSshConfig(r.host)
+	addr := r.host
+	if cfg.hostName != "" {
+		addr = cfg.hostName
+	}
+	port := r.port
+	if port == "" {
+		port = cfg.port
+	}
+	if port == "" {
+		port = "22"
+	}
+	user := r.user
+	if user == "" {
+		user = cfg.user
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	knownHostsFile := cfg.knownHostsFile
+	if knownHostsFile == "" {
+		knownHostsFile = os.ExpandEnv("$HOME/.ssh/known_hosts")
+	}
+
+	r.logf("Connecting to %s %s", user, net.JoinHostPort(addr, port))
+	return ssh.Dial("tcp", net.JoinHostPort(addr, port), &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return r.sshSigners(cfg.identityFiles), nil
+		})},
+		HostKeyCallback:   r.hostKeyCallback(knownHostsFile),
+		HostKeyAlgorithms: knownHostKeyAlgorithms(knownHostsFile, net.JoinHostPort(addr, port)),
+	})
+}